@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -57,6 +59,11 @@ func guide() string {
 const (
 	prefSrvAddr = "srv-addr"
 	prefTextLim = "text-limit"
+	prefTypeDly = "type-delay-ms"
+	prefTypeHld = "type-hold-ms"
+	prefNewline = "newline-policy"
+	prefTab     = "tab-policy"
+	prefTypePol = "type-policies"
 	prefClients = "clients"
 	prefSCHost  = "single-client-host"
 	prefAPIs    = "apis"
@@ -69,6 +76,12 @@ func initPrefs(prefs fyne.Preferences) {
 	if prefs.Int(prefTextLim) < 1 {
 		prefs.SetInt(prefTextLim, 250)
 	}
+	if prefs.String(prefNewline) == "" {
+		prefs.SetString(prefNewline, internal.DropCtrl.String())
+	}
+	if prefs.String(prefTab) == "" {
+		prefs.SetString(prefTab, internal.DropCtrl.String())
+	}
 	if prefs.String(prefClients) == "" {
 		prefs.SetString(prefClients, "local")
 	}
@@ -126,6 +139,9 @@ func main() {
 	))
 	wapp.SetContent(mainBox)
 	wapp.ShowAndRun()
+	if err := gamcro.Shutdown(context.Background()); err != nil {
+		log.Println(err)
+	}
 }
 
 func startGamcro() {
@@ -149,10 +165,16 @@ func startGamcro() {
 	gamcro.MultiClient = !prefs.Bool(prefSCHost)
 	gamcro.ClientNet = prefs.String(prefClients)
 	gamcro.TxtLimit = prefs.Int(prefTextLim)
+	gamcro.TypeDelay = time.Duration(prefs.Int(prefTypeDly)) * time.Millisecond
+	gamcro.TypeHold = time.Duration(prefs.Int(prefTypeHld)) * time.Millisecond
+	gamcro.NewlinePolicy, _ = internal.ParseTypePolicy(prefs.String(prefNewline))
+	gamcro.TabPolicy, _ = internal.ParseTypePolicy(prefs.String(prefTab))
+	gamcro.TypePolicies = internal.ParseTypePolicies(prefs.String(prefTypePol))
 	gamcro.TLSCert = paths.LocalData("cert.pem")
 	gamcro.TLSKey = paths.LocalData("key.pem")
 	gamcro.APIs = apisTab.apis
 	gamcro.TextsDir = paths.LocalDataPath(internal.DefaultTextsDir)
+	gamcro.MacrosDir = paths.LocalDataPath(internal.DefaultMacrosDir)
 
 	connectTab.setHint(gamcro.ConnectHint())
 	mainBox.Remove(startBtn)
@@ -160,12 +182,20 @@ func startGamcro() {
 		"Browser Login to Gamcro: %s",
 		internal.CurrentRealmKey,
 	)))
+	macroSetLabel := widget.NewLabel(macroSetText(""))
+	mainBox.Add(macroSetLabel)
+	gamcro.OnMacroSet = func(name string) {
+		macroSetLabel.SetText(macroSetText(name))
+	}
 
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
 	enc.Encode(&gamcro)
 	go func() {
 		err := gamcro.Run()
+		if err == nil {
+			return
+		}
 		log.Println(err)
 		info := dialog.NewInformation("Error running Gamcro", err.Error(), wapp)
 		info.SetOnClosed(func() {
@@ -175,3 +205,10 @@ func startGamcro() {
 		info.Show()
 	}()
 }
+
+func macroSetText(name string) string {
+	if name == "" {
+		return "No macro set"
+	}
+	return fmt.Sprintf("Macro set: %s", name)
+}
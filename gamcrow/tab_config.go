@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
 
 	"fyne.io/fyne/v2"
@@ -69,6 +70,35 @@ func NewConfigTab(prefs fyne.Preferences, gamcro *internal.Gamcro) *ConfigTab {
 	}
 	txtLimEntry.SetText(strconv.Itoa(prefs.Int(prefTextLim)))
 
+	typeDlyEntry := msecEntry(prefs, prefTypeDly, "Typing delay", 500)
+	typeHldEntry := msecEntry(prefs, prefTypeHld, "Key hold", 250)
+
+	var policies []string
+	for p := internal.TypePolicy(1); p < internal.TypePolicy_end; p <<= 1 {
+		policies = append(policies, p.String())
+	}
+	newlineSelect := widget.NewSelect(policies, nil)
+	newlineSelect.SetSelected(prefs.String(prefNewline))
+	newlineSelect.OnChanged = func(s string) { prefs.SetString(prefNewline, s) }
+	tabSelect := widget.NewSelect(policies, nil)
+	tabSelect.SetSelected(prefs.String(prefTab))
+	tabSelect.OnChanged = func(s string) { prefs.SetString(prefTab, s) }
+	typePols := internal.ParseTypePolicies(prefs.String(prefTypePol))
+	var polChecks []fyne.CanvasObject
+	for p := internal.TypePolicy(1); p < internal.TypePolicy_end; p <<= 1 {
+		bit := p
+		chk := widget.NewCheck(p.String(), func(f bool) {
+			if f {
+				typePols |= bit
+			} else {
+				typePols &= ^bit
+			}
+			prefs.SetString(prefTypePol, typePols.FlagString())
+		})
+		chk.SetChecked(typePols.Active(p))
+		polChecks = append(polChecks, chk)
+	}
+
 	clientsSelect := widget.NewSelect(
 		[]string{"local", "all"}, nil,
 	)
@@ -82,6 +112,11 @@ func NewConfigTab(prefs fyne.Preferences, gamcro *internal.Gamcro) *ConfigTab {
 			binding.BindPreferenceString(prefSrvAddr, prefs),
 		)),
 		widget.NewFormItem("Text Limit", txtLimEntry),
+		widget.NewFormItem("Typing Delay [ms]", typeDlyEntry),
+		widget.NewFormItem("Key Hold [ms]", typeHldEntry),
+		widget.NewFormItem("Newlines", newlineSelect),
+		widget.NewFormItem("Tabs", tabSelect),
+		widget.NewFormItem("Client Choices", container.NewHBox(polChecks...)),
 		widget.NewFormItem("Clients", clientsSelect),
 	)
 
@@ -98,3 +133,23 @@ func NewConfigTab(prefs fyne.Preferences, gamcro *internal.Gamcro) *ConfigTab {
 	)
 	return res
 }
+
+// msecEntry edits the milliseconds in the integer preference pref that must
+// be between 0 and max.
+func msecEntry(prefs fyne.Preferences, pref, what string, max int) *widget.Entry {
+	e := widget.NewEntry()
+	e.Validator = func(s string) error {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 || i > max {
+			return fmt.Errorf("%s must be an integer from 0 to %d.", what, max)
+		}
+		return nil
+	}
+	e.OnChanged = func(s string) {
+		if i, err := strconv.Atoi(s); err == nil && i >= 0 && i <= max {
+			prefs.SetInt(pref, i)
+		}
+	}
+	e.SetText(strconv.Itoa(prefs.Int(pref)))
+	return e
+}
@@ -0,0 +1,436 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"git.fractalqb.de/fractalqb/xsx"
+)
+
+// ImportAHK converts an AutoHotkey script into the source of a macro set.
+// The supported subset of AHK is:
+//
+//   - Hotkey labels 'keys::' start a macro that ends with 'Return'. The
+//     macro is named after the hotkey, e.g. '^j::' becomes 'ctrl-j'. A
+//     single-line hotkey 'keys::command' is a macro with one command.
+//   - Commands outside of hotkeys make up the macro called name. It is an
+//     error if name needs quoting or is a directive like include.
+//   - Send, SendInput, SendEvent, SendPlay and SendRaw with the Send syntax:
+//     Modifiers ^ ! + # for the next key, {Key}, {Key N}, {Key down},
+//     {Key up}, escaped characters like {!} and {{}, {Raw} and {Text}.
+//     Other characters are typed as text.
+//   - Sleep with a delay in milliseconds.
+//   - Comments starting with ';' and the escapes `n, `t and `c for a
+//     literal character c.
+//
+// Everything else is reported as a MacroError for its line and left out. The
+// resulting source is returned even if there are errors. If the result is
+// not accepted by the macro loader, only the loader's errors are returned.
+func ImportAHK(file, name string, src []byte) ([]byte, error) {
+	imp := ahkImporter{file: file, names: make(map[string]bool)}
+	scn := bufio.NewScanner(bytes.NewReader(src))
+	for scn.Scan() {
+		imp.line++
+		imp.importLine(scn.Text())
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+	imp.endMacro()
+	if len(imp.top) > 0 {
+		imp.line = 0
+		imp.addMacro(name, imp.top)
+	}
+	res, err := FormatMacroSrc(file, imp.out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("import %s produced invalid macros: %w", file, err)
+	}
+	if _, err := parseMacroSet(name, file, res); err != nil {
+		return nil, fmt.Errorf("import %s produced invalid macros: %w", file, err)
+	}
+	if len(imp.errs) > 0 {
+		return res, imp.errs
+	}
+	return res, nil
+}
+
+type ahkImporter struct {
+	file  string
+	line  int
+	errs  MacroErrors
+	names map[string]bool
+	out   bytes.Buffer
+	// macro is the name of the current hotkey macro, "" outside of hotkeys.
+	macro string
+	steps []string
+	top   []string
+}
+
+func (imp *ahkImporter) errorf(format string, args ...interface{}) {
+	imp.errs = append(imp.errs, &MacroError{
+		File:   imp.file,
+		Macro:  imp.macro,
+		srcPos: srcPos{Line: imp.line, Col: 1},
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+func (imp *ahkImporter) addMacro(name string, steps []string) {
+	if err := checkMacroName(name); err != nil {
+		imp.errorf("%s", err)
+		return
+	}
+	if imp.names[name] {
+		imp.errorf("duplicate macro '%s'", name)
+		return
+	}
+	imp.names[name] = true
+	fmt.Fprintf(&imp.out, "(%s %s)\n", name, strings.Join(steps, " "))
+}
+
+func (imp *ahkImporter) endMacro() {
+	if imp.macro == "" {
+		return
+	}
+	if len(imp.steps) == 0 {
+		imp.errorf("hotkey '%s' has no supported commands", imp.macro)
+	} else {
+		imp.addMacro(imp.macro, imp.steps)
+	}
+	imp.macro, imp.steps = "", nil
+}
+
+func (imp *ahkImporter) importLine(line string) {
+	line = strings.TrimSpace(ahkStripComment(line))
+	if line == "" {
+		return
+	}
+	if strings.HasPrefix(line, "::") {
+		imp.errorf("hotstrings are not supported")
+		return
+	}
+	if i := strings.Index(line, "::"); i > 0 && !strings.ContainsAny(line[:i], " \t,") {
+		imp.endMacro()
+		name, ok := ahkHotkeyName(line[:i])
+		if !ok {
+			imp.errorf("unsupported hotkey '%s'", line[:i])
+			return
+		}
+		imp.macro = name
+		if cmd := strings.TrimSpace(line[i+2:]); cmd != "" {
+			imp.command(cmd)
+			imp.endMacro()
+		}
+		return
+	}
+	if strings.EqualFold(line, "return") {
+		if imp.macro == "" {
+			imp.errorf("return outside of hotkey")
+		}
+		imp.endMacro()
+		return
+	}
+	imp.command(line)
+}
+
+func (imp *ahkImporter) command(line string) {
+	cmd, arg := line, ""
+	if i := strings.IndexAny(line, " \t,"); i >= 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i:])
+		arg = strings.TrimSpace(strings.TrimPrefix(arg, ","))
+	}
+	var steps []string
+	switch strings.ToLower(cmd) {
+	case "send", "sendinput", "sendevent", "sendplay":
+		steps = imp.send(arg, false)
+	case "sendraw":
+		steps = imp.send(arg, true)
+	case "sleep":
+		ms, err := strconv.Atoi(arg)
+		if err != nil || ms < 0 || ms > int(maxMacroDuration.Milliseconds()) {
+			imp.errorf("invalid sleep time '%s'", arg)
+			return
+		}
+		steps = []string{fmt.Sprintf("(wait %dms)", ms)}
+	default:
+		imp.errorf("unsupported command '%s'", cmd)
+		return
+	}
+	if imp.macro == "" {
+		imp.top = append(imp.top, steps...)
+	} else {
+		imp.steps = append(imp.steps, steps...)
+	}
+}
+
+// send converts the keys of a Send command into macro steps.
+func (imp *ahkImporter) send(keys string, raw bool) (steps []string) {
+	keys = ahkUnescape(keys)
+	var txt strings.Builder
+	flush := func() {
+		if txt.Len() > 0 {
+			steps = append(steps, xsx.Quoted(strings.ReplaceAll(txt.String(), "$", "$$")))
+			txt.Reset()
+		}
+	}
+	var mods []string
+	for len(keys) > 0 {
+		if raw {
+			txt.WriteString(keys)
+			break
+		}
+		c := keys[0]
+		if mod, ok := ahkModifiers[c]; ok && len(keys) > 1 {
+			mods = append(mods, mod)
+			keys = keys[1:]
+			continue
+		}
+		if c == '{' {
+			end := strings.IndexByte(keys[1:], '}')
+			if end == 0 { // {}} sends a '}'
+				end = strings.IndexByte(keys[2:], '}') + 1
+			}
+			if end < 0 {
+				imp.errorf("missing '}' in '%s'", keys)
+				break
+			}
+			brace := keys[1 : end+1]
+			keys = keys[end+2:]
+			switch strings.ToLower(brace) {
+			case "raw", "text":
+				raw = true
+				continue
+			}
+			step, lit := imp.braceKey(brace, mods)
+			mods = nil
+			switch {
+			case lit != "":
+				txt.WriteString(lit)
+			case step != "":
+				flush()
+				steps = append(steps, step)
+			}
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(keys)
+		keys = keys[size:]
+		var key string
+		switch {
+		case r == '\n':
+			key = "enter"
+		case r == '\t':
+			key = "tab"
+		case r == ' ' && len(mods) > 0:
+			key = "space"
+		case len(mods) == 0:
+			txt.WriteRune(r)
+			continue
+		default:
+			key = strings.ToLower(string(r))
+		}
+		if xsx.NeedQuote(key) {
+			imp.errorf("unsupported key '%c' with modifiers", r)
+			mods = nil
+			continue
+		}
+		flush()
+		if len(mods) == 0 {
+			steps = append(steps, key)
+		} else {
+			steps = append(steps, fmt.Sprintf("[%s %s]", key, strings.Join(mods, " ")))
+		}
+		mods = nil
+	}
+	flush()
+	return steps
+}
+
+// braceKey converts {key}, {key N}, {key down} and {key up}. Single
+// characters without modifiers are returned as literal text.
+func (imp *ahkImporter) braceKey(brace string, mods []string) (step, lit string) {
+	name, arg := brace, ""
+	if i := strings.LastIndexByte(brace, ' '); i > 0 {
+		name, arg = brace[:i], strings.ToLower(strings.TrimSpace(brace[i+1:]))
+	}
+	if utf8.RuneCountInString(name) == 1 && len(mods) == 0 && arg == "" {
+		return "", name
+	}
+	key, ok := ahkKey(name)
+	if !ok || xsx.NeedQuote(key) {
+		imp.errorf("unsupported key '{%s}'", brace)
+		return "", ""
+	}
+	tap := key
+	if len(mods) > 0 {
+		tap = fmt.Sprintf("[%s %s]", key, strings.Join(mods, " "))
+	}
+	switch arg {
+	case "":
+		return tap, ""
+	case "down", "up":
+		return fmt.Sprintf("[\\%s %s]", arg, strings.TrimSuffix(strings.TrimPrefix(tap, "["), "]")), ""
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > maxMacroRepeat {
+		imp.errorf("unsupported key argument in '{%s}'", brace)
+		return "", ""
+	}
+	if n == 1 {
+		return tap, ""
+	}
+	return fmt.Sprintf("(repeat %d %s)", n, tap), ""
+}
+
+var ahkModifiers = map[byte]string{
+	'^': "ctrl",
+	'!': "alt",
+	'+': "shift",
+	'#': "cmd",
+}
+
+// ahkKeys maps AHK key names in lower case to robotgo key names.
+var ahkKeys = map[string]string{
+	"enter":            "enter",
+	"return":           "enter",
+	"tab":              "tab",
+	"esc":              "esc",
+	"escape":           "esc",
+	"space":            "space",
+	"bs":               "backspace",
+	"backspace":        "backspace",
+	"del":              "delete",
+	"delete":           "delete",
+	"ins":              "insert",
+	"insert":           "insert",
+	"home":             "home",
+	"end":              "end",
+	"pgup":             "pageup",
+	"pgdn":             "pagedown",
+	"up":               "up",
+	"down":             "down",
+	"left":             "left",
+	"right":            "right",
+	"capslock":         "capslock",
+	"printscreen":      "printscreen",
+	"appskey":          "menu",
+	"ctrl":             "ctrl",
+	"control":          "ctrl",
+	"lctrl":            "lctrl",
+	"rctrl":            "rctrl",
+	"alt":              "alt",
+	"lalt":             "lalt",
+	"ralt":             "ralt",
+	"shift":            "shift",
+	"lshift":           "lshift",
+	"rshift":           "rshift",
+	"lwin":             "lcmd",
+	"rwin":             "rcmd",
+	"numpadenter":      "num_enter",
+	"numpadadd":        "num+",
+	"numpadsub":        "num-",
+	"numpadmult":       "num*",
+	"numpaddiv":        "num/",
+	"numpaddot":        "num.",
+	"volume_mute":      "audio_mute",
+	"volume_up":        "audio_vol_up",
+	"volume_down":      "audio_vol_down",
+	"media_play_pause": "audio_play",
+	"media_stop":       "audio_stop",
+	"media_next":       "audio_next",
+	"media_prev":       "audio_prev",
+}
+
+func ahkKey(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if k, ok := ahkKeys[name]; ok {
+		return k, true
+	}
+	if len(name) == 1 {
+		return name, true
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(name, "f")); err == nil &&
+		name[0] == 'f' && n >= 1 && n <= 24 {
+		return name, true
+	}
+	if d := strings.TrimPrefix(name, "numpad"); len(d) == 1 && d[0] >= '0' && d[0] <= '9' {
+		return "num" + d, true
+	}
+	return "", false
+}
+
+// checkMacroName returns an error if name cannot be the name of a macro
+// definition.
+func checkMacroName(name string) error {
+	switch {
+	case name == "" || xsx.NeedQuote(name) || strings.HasPrefix(name, `\`):
+		return fmt.Errorf("'%s' is not a valid macro name", name)
+	case name == "include" || name == "anchor":
+		return fmt.Errorf("macro name '%s' is a directive", name)
+	}
+	return nil
+}
+
+// ahkHotkeyName turns a hotkey label like '^!j' into a macro name like
+// 'ctrl-alt-j'.
+func ahkHotkeyName(label string) (string, bool) {
+	var parts []string
+	label = strings.TrimLeft(label, "*~$<>")
+	for len(label) > 1 {
+		mod, ok := ahkModifiers[label[0]]
+		if !ok {
+			break
+		}
+		parts = append(parts, mod)
+		label = strings.TrimLeft(label[1:], "<>")
+	}
+	key, ok := ahkKey(label)
+	if !ok || strings.ContainsAny(key, "()[]{}\"\\$ ") {
+		return "", false
+	}
+	return strings.Join(append(parts, key), "-"), true
+}
+
+// ahkStripComment removes a comment that starts with ';' at the beginning
+// of line or after white space.
+func ahkStripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '`':
+			i++
+		case ';':
+			if i == 0 || line[i-1] == ' ' || line[i-1] == '\t' {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// ahkUnescape resolves the AHK escape sequences `n, `t and `c to newline, tab
+// and c.
+func ahkUnescape(s string) string {
+	if !strings.ContainsRune(s, '`') {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '`' || i+1 == len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestImportAHK(t *testing.T) {
+	src, err := ImportAHK("test.ahk", "test", []byte(`; comment
+^!j::
+Send, ^c{Enter}Hi $who{!} ; greet
+Sleep 250
+Send {Shift down}{Tab 2}{Shift up}{{}x{}}
+return
+F2::SendRaw {not a key}
+F3::Send ^ä+Ö{é} ø
+`+"Send +{F1}a`n`;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `(ctrl-alt-j
+  [c ctrl]
+  enter
+  "Hi $$who!"
+  (wait 250ms)
+  [\down shift]
+  (repeat 2
+    tab)
+  [\up shift]
+  "{x}")
+
+(f2
+  "{not a key}")
+
+(f3
+  [ä ctrl]
+  [ö shift]
+  "é ø")
+
+(test
+  [f1 shift]
+  "a"
+  enter
+  ";")
+`
+	if string(src) != expect {
+		t.Errorf("unexpected macros:\n%s", src)
+	}
+	mset, err := parseMacroSet("test", "test.xsx", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(mset.macros); l != 4 {
+		t.Errorf("expect 4 macros, got %d", l)
+	}
+}
+
+func TestImportAHK_errors(t *testing.T) {
+	src, err := ImportAHK("test.ahk", "test", []byte(`#NoEnv
+a::
+MsgBox hello
+Send {Foo}x{Tab many}
+Sleep soon
+return
+::btw::by the way
+b::Send +(
+return
+Send {Enter`))
+	merrs, ok := err.(MacroErrors)
+	if !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	lines := []int{1, 3, 4, 4, 5, 7, 8, 8, 9, 10}
+	if len(merrs) != len(lines) {
+		t.Fatalf("expect %d errors, got %d:\n%s", len(lines), len(merrs), err)
+	}
+	for i, l := range lines {
+		if merrs[i].Line != l {
+			t.Errorf("error %d in line %d, expect %d: %s", i, merrs[i].Line, l, merrs[i])
+		}
+	}
+	if _, err := parseMacroSet("test", "test.xsx", src); err != nil {
+		t.Errorf("imported macros do not load: %s", err)
+	}
+}
+
+func TestImportAHK_names(t *testing.T) {
+	for _, name := range []string{"my script", "include", "anchor", `\x`, ""} {
+		src, err := ImportAHK("test.ahk", name, []byte("Send x\na::Send y"))
+		merrs, ok := err.(MacroErrors)
+		if !ok || len(merrs) != 1 {
+			t.Errorf("name '%s': unexpected error %v", name, err)
+			continue
+		}
+		if string(src) != "(a\n  \"y\")\n" {
+			t.Errorf("name '%s': unexpected macros %q", name, src)
+		}
+	}
+}
+
+func TestImportAHK_loaderErrors(t *testing.T) {
+	src, err := ImportAHK("test.ahk", "test", []byte("Send {a 2000}"))
+	if err == nil || src != nil {
+		t.Errorf("repeat count over the macro limit imported as %q", src)
+	}
+}
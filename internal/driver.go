@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"github.com/atotto/clipboard"
+	"github.com/go-vgo/robotgo"
+)
+
+// InputDriver sends keyboard and mouse input to the desktop. Methods that
+// return a string return an error message or "" on success.
+type InputDriver interface {
+	KeyTap(key string, mods ...string) string
+	KeyToggle(key string, down bool, mods ...string) string
+	TypeStr(txt string)
+	MouseClick(button string, double bool)
+	MouseToggle(action, button string)
+	MousePos() (x, y int)
+	ScreenSize() (w, h int)
+	WindowBounds() (x, y, w, h int)
+	// WindowTitle returns the title of the active window.
+	WindowTitle() string
+	MoveMouse(x, y int)
+	// MoveSmooth moves the mouse pointer to x, y along a human-like path.
+	MoveSmooth(x, y int)
+	DragMouse(x, y int)
+	ScrollMouse(count int, dir string)
+}
+
+// Clipboard reads and writes the text of the system clipboard.
+type Clipboard interface {
+	ReadAll() (string, error)
+	WriteAll(txt string) error
+}
+
+// RoboDriver is the InputDriver that uses robotgo.
+type RoboDriver struct{}
+
+var _ InputDriver = RoboDriver{}
+
+func (RoboDriver) KeyTap(key string, mods ...string) string {
+	args := make([]interface{}, len(mods))
+	for i := range mods {
+		args[i] = mods[i]
+	}
+	return robotgo.KeyTap(key, args...)
+}
+
+func (RoboDriver) KeyToggle(key string, down bool, mods ...string) string {
+	dir := "up"
+	if down {
+		dir = "down"
+	}
+	return robotgo.KeyToggle(key, append([]string{dir}, mods...)...)
+}
+
+func (RoboDriver) TypeStr(txt string)                    { robotgo.TypeStr(txt) }
+func (RoboDriver) MouseClick(button string, double bool) { robotgo.MouseClick(button, double) }
+func (RoboDriver) MouseToggle(action, button string)     { robotgo.MouseToggle(action, button) }
+func (RoboDriver) MousePos() (x, y int)                  { return robotgo.GetMousePos() }
+func (RoboDriver) ScreenSize() (w, h int)                { return robotgo.GetScreenSize() }
+func (RoboDriver) WindowBounds() (x, y, w, h int)        { return robotgo.GetBounds(robotgo.GetPID()) }
+func (RoboDriver) WindowTitle() string                   { return robotgo.GetTitle() }
+func (RoboDriver) MoveMouse(x, y int)                    { robotgo.MoveMouse(x, y) }
+func (RoboDriver) MoveSmooth(x, y int)                   { robotgo.MoveSmooth(x, y) }
+func (RoboDriver) DragMouse(x, y int)                    { robotgo.DragMouse(x, y) }
+func (RoboDriver) ScrollMouse(count int, dir string)     { robotgo.ScrollMouse(count, dir) }
+
+// SysClipboard is the Clipboard of the operating system.
+type SysClipboard struct{}
+
+var _ Clipboard = SysClipboard{}
+
+func (SysClipboard) ReadAll() (string, error)  { return clipboard.ReadAll() }
+func (SysClipboard) WriteAll(txt string) error { return clipboard.WriteAll(txt) }
@@ -0,0 +1,753 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// recDriver is an InputDriver and Clipboard that records all input as
+// strings instead of sending it to the desktop.
+type recDriver struct {
+	mu     sync.Mutex
+	input  []string
+	x, y   int
+	clip   string
+	title  string
+	failOn string
+}
+
+func (d *recDriver) rec(format string, args ...interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.input = append(d.input, fmt.Sprintf(format, args...))
+}
+
+func (d *recDriver) recorded() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.input...)
+}
+
+func (d *recDriver) KeyTap(key string, mods ...string) string {
+	if key == d.failOn {
+		return "invalid key"
+	}
+	d.rec("tap %s %v", key, mods)
+	return ""
+}
+
+func (d *recDriver) KeyToggle(key string, down bool, mods ...string) string {
+	d.rec("toggle %s %t %v", key, down, mods)
+	return ""
+}
+
+func (d *recDriver) TypeStr(txt string) { d.rec("type %s", txt) }
+
+func (d *recDriver) MouseClick(button string, double bool) {
+	d.rec("click %s %t", button, double)
+}
+
+func (d *recDriver) MouseToggle(action, button string) {
+	d.rec("button %s %s", button, action)
+}
+
+func (d *recDriver) MousePos() (x, y int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.x, d.y
+}
+
+func (d *recDriver) ScreenSize() (w, h int) { return 1000, 800 }
+
+func (d *recDriver) WindowBounds() (x, y, w, h int) { return 100, 50, 400, 300 }
+
+func (d *recDriver) WindowTitle() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.title
+}
+
+func (d *recDriver) setTitle(title string) {
+	d.mu.Lock()
+	d.title = title
+	d.mu.Unlock()
+}
+
+func (d *recDriver) MoveMouse(x, y int) {
+	d.rec("move %d %d", x, y)
+	d.mu.Lock()
+	d.x, d.y = x, y
+	d.mu.Unlock()
+}
+
+func (d *recDriver) MoveSmooth(x, y int) {
+	d.rec("move-smooth %d %d", x, y)
+	d.mu.Lock()
+	d.x, d.y = x, y
+	d.mu.Unlock()
+}
+
+func (d *recDriver) DragMouse(x, y int) {
+	d.rec("drag %d %d", x, y)
+	d.mu.Lock()
+	d.x, d.y = x, y
+	d.mu.Unlock()
+}
+
+func (d *recDriver) ScrollMouse(count int, dir string) {
+	d.rec("scroll %d %s", count, dir)
+}
+
+func (d *recDriver) ReadAll() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.clip, nil
+}
+
+func (d *recDriver) WriteAll(txt string) error {
+	d.rec("clip %s", txt)
+	d.mu.Lock()
+	d.clip = txt
+	d.mu.Unlock()
+	return nil
+}
+
+// testServer returns a Gamcro with all APIs active that sends its input to a
+// recDriver, and the Gamcro's API routes.
+func testServer(t *testing.T) (*Gamcro, *recDriver, http.Handler) {
+	drv := &recDriver{}
+	g := &Gamcro{
+		ClientNet: "all",
+		TxtLimit:  64,
+		APIs:      GamcroAPI_end - 1,
+		Input:     drv,
+		Clipboard: drv,
+	}
+	if err := g.ClientAuth.Set("test", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	g.apiRoutes(r)
+	return g, drv, r
+}
+
+func testRequest(h http.Handler, method, url, ctype, body string) *httptest.ResponseRecorder {
+	rq := httptest.NewRequest(method, url, strings.NewReader(body))
+	rq.SetBasicAuth("test", "secret")
+	if ctype != "" {
+		rq.Header.Set("Content-Type", ctype)
+	}
+	rrec := httptest.NewRecorder()
+	h.ServeHTTP(rrec, rq)
+	return rrec
+}
+
+func TestEndToEnd_keyboard(t *testing.T) {
+	_, drv, h := testServer(t)
+	if rrec := testRequest(h, http.MethodPost, "/keyboard/type",
+		"text/plain", "Hello\tWorld\x00!"); rrec.Code != http.StatusNoContent {
+		t.Fatalf("type: %s", rrec.Result().Status)
+	}
+	if rrec := testRequest(h, http.MethodPost, "/keyboard/tap/a?arg=ctrl&arg=shift",
+		"", ""); rrec.Code != http.StatusNoContent {
+		t.Fatalf("tap: %s", rrec.Result().Status)
+	}
+	drv.failOn = "nokey"
+	if rrec := testRequest(h, http.MethodPost, "/keyboard/tap/nokey",
+		"", ""); rrec.Code != http.StatusInternalServerError {
+		t.Errorf("tap invalid key: %s", rrec.Result().Status)
+	}
+	expect := []string{"type HelloWorld!", "tap a [ctrl shift]"}
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("unexpected input %q", in)
+	}
+}
+
+func TestEndToEnd_keyboardTiming(t *testing.T) {
+	g, drv, h := testServer(t)
+	g.TypeDelay = 5 * time.Millisecond
+	for _, q := range []string{"delay=1s", "hold=-1ms", "delay=fast", "hold=1ms&hold=2ms"} {
+		if rrec := testRequest(h, http.MethodPost, "/keyboard/type?"+q,
+			"text/plain", "x"); rrec.Code != http.StatusBadRequest {
+			t.Errorf("type with %s: %s", q, rrec.Result().Status)
+		}
+	}
+	g.TxtLimit = 256
+	if rrec := testRequest(h, http.MethodPost, "/keyboard/type?delay=500ms",
+		"text/plain", strings.Repeat("x", 121)); rrec.Code != http.StatusBadRequest {
+		t.Errorf("type for too long: %s", rrec.Result().Status)
+	}
+	start := time.Now()
+	if rrec := testRequest(h, http.MethodPost, "/keyboard/type?hold=10ms",
+		"text/plain", "Hi!"); rrec.Code != http.StatusNoContent {
+		t.Fatalf("type: %s", rrec.Result().Status)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("typed too fast in %s", d)
+	}
+	if rrec := testRequest(h, http.MethodPost, "/keyboard/type?delay=0s&speed=1",
+		"text/plain", "ok"); rrec.Code != http.StatusNoContent {
+		t.Fatalf("type: %s", rrec.Result().Status)
+	}
+	expect := []string{
+		"toggle h true [shift]", "toggle h false [shift]",
+		"toggle i true []", "toggle i false []",
+		"type !",
+		"type ok",
+	}
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("unexpected input %q", in)
+	}
+}
+
+func TestEndToEnd_keyboardPolicies(t *testing.T) {
+	g, drv, h := testServer(t)
+	g.NewlinePolicy, g.TabPolicy = TapEnter, DropCtrl
+	g.TypePolicies = TapShiftEnter | TapTab
+	const txt = "a\r\nb\tc\rd\n"
+	for q, code := range map[string]int{
+		"newline=return":              http.StatusBadRequest,
+		"tab=tab&tab=drop":            http.StatusBadRequest,
+		"newline=drop":                http.StatusForbidden,
+		"newline=enter&tab=enter":     http.StatusForbidden,
+		"newline=shift-enter&tab=tab": http.StatusNoContent,
+	} {
+		if rrec := testRequest(h, http.MethodPost, "/keyboard/type?"+q,
+			"text/plain", txt); rrec.Code != code {
+			t.Errorf("type with %s: %s", q, rrec.Result().Status)
+		}
+	}
+	if rrec := testRequest(h, http.MethodPost, "/keyboard/type",
+		"text/plain", txt); rrec.Code != http.StatusNoContent {
+		t.Fatalf("type: %s", rrec.Result().Status)
+	}
+	expect := []string{
+		"type a", "tap enter [shift]", "type b", "tap tab []", "type c",
+		"tap enter [shift]", "type d", "tap enter [shift]",
+		"type a", "tap enter []", "type bc", "tap enter []", "type d", "tap enter []",
+	}
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("unexpected input %q", in)
+	}
+}
+
+func TestEndToEnd_clip(t *testing.T) {
+	_, drv, h := testServer(t)
+	if rrec := testRequest(h, http.MethodPost, "/clip",
+		"text/plain; charset=utf-8", "to clip\n"); rrec.Code != http.StatusNoContent {
+		t.Fatalf("clip post: %s", rrec.Result().Status)
+	}
+	rrec := testRequest(h, http.MethodGet, "/clip", "", "")
+	if rrec.Code != http.StatusOK {
+		t.Fatalf("clip get: %s", rrec.Result().Status)
+	}
+	if body, _ := io.ReadAll(rrec.Body); string(body) != "to clip" {
+		t.Errorf("clip get returned '%s'", body)
+	}
+	if in := drv.recorded(); !reflect.DeepEqual(in, []string{"clip to clip"}) {
+		t.Errorf("unexpected input %q", in)
+	}
+}
+
+func TestEndToEnd_macro(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 0}
+(greet \{params "who x"} [\down Shift] "Hi $who" [\up Shift]
+  {click $x +10 right click scroll 1 up})`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, drv, h := testServer(t)
+	g.macros.replace([]*macroCfg{mset}, "")
+	drv.x, drv.y = 5, 5
+	rrec := testRequest(h, http.MethodPost, "/macros/greet/run",
+		"application/json", `{"who":"Bob","x":100}`)
+	if rrec.Code != http.StatusAccepted {
+		t.Fatalf("run macro: %s", rrec.Result().Status)
+	}
+	var job macroJob
+	if err := json.NewDecoder(rrec.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == 0 {
+		t.Fatal("no job ID")
+	}
+	g.inputs().do(func() {}) // wait for the macro to finish
+	expect := []string{
+		"toggle Shift true []",
+		"type Hi Bob",
+		"toggle Shift false []",
+		"move 100 15",
+		"click right false",
+		"scroll 1 up",
+	}
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("unexpected input %q", in)
+	}
+}
+
+func TestEndToEnd_macroTexts(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 0}
+(trade \{params "item"} Enter (text trade 2) (clip "WTS $item") (paste) (text trade 3))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, drv, h := testServer(t)
+	g.macros.replace([]*macroCfg{mset}, "")
+	g.texts.put("trade", []string{"WTB", "LF\tgroup\x00"})
+	rrec := testRequest(h, http.MethodPost, "/macros/trade/run?item=Sword", "", "")
+	if rrec.Code != http.StatusAccepted {
+		t.Fatalf("run macro: %s", rrec.Result().Status)
+	}
+	g.inputs().do(func() {})
+	expect := []string{
+		"tap Enter []",
+		"type LFgroup",
+		"clip WTS Sword",
+		fmt.Sprintf("tap v %v", pasteMods()),
+	}
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("unexpected input %q", in)
+	}
+	g.texts.put("trade", []string{"WTB", strings.Repeat("x", g.TxtLimit+1), "LFG"})
+	if rrec = testRequest(h, http.MethodPost, "/macros/trade/run?item=Sword", "", ""); rrec.Code != http.StatusAccepted {
+		t.Fatalf("run macro: %s", rrec.Result().Status)
+	}
+	g.inputs().do(func() {})
+	expect = append(expect, "tap Enter []")
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("text over limit typed: %q", in)
+	}
+	long := strings.Repeat("é", g.TxtLimit)
+	g.texts.put("trade", []string{"WTB", long, "LFG"})
+	rrec = testRequest(h, http.MethodPost, "/macros/trade/run?item="+url.QueryEscape(long), "", "")
+	if rrec.Code != http.StatusAccepted {
+		t.Fatalf("run macro with text at limit: %s", rrec.Result().Status)
+	}
+	g.inputs().do(func() {})
+	expect = append(expect,
+		"tap Enter []",
+		"type "+long,
+		"clip WTS "+long,
+		fmt.Sprintf("tap v %v", pasteMods()),
+		"type LFG",
+	)
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("text at limit not typed: %q", in)
+	}
+}
+
+func TestEndToEnd_macroToggle(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 0}
+(farm \{repeat 5ms} [\down e] (wait 1s) [\up e])
+(once x)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, drv, h := testServer(t)
+	g.macros.replace([]*macroCfg{mset}, "")
+	if rrec := testRequest(h, http.MethodPost, "/macros/once/toggle", "", ""); rrec.Code != http.StatusBadRequest {
+		t.Errorf("toggle macro without repeat: %s", rrec.Result().Status)
+	}
+	running := func() (ls []repeaterState) {
+		rrec := testRequest(h, http.MethodGet, "/macros/running", "", "")
+		if err := json.NewDecoder(rrec.Body).Decode(&ls); err != nil {
+			t.Fatal(err)
+		}
+		return ls
+	}
+	if rrec := testRequest(h, http.MethodPost, "/macros/farm/toggle", "", ""); rrec.Code != http.StatusAccepted {
+		t.Fatalf("start repeating: %s", rrec.Result().Status)
+	}
+	if ls := running(); len(ls) != 1 || ls[0].Macro != "farm" || ls[0].Interval != 5 {
+		t.Errorf("unexpected running macros %+v", ls)
+	}
+	for start := time.Now(); len(drv.recorded()) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("repeated macro did not start")
+		}
+	}
+	if rrec := testRequest(h, http.MethodPost, "/macros/farm/toggle", "", ""); rrec.Code != http.StatusNoContent {
+		t.Fatalf("stop repeating: %s", rrec.Result().Status)
+	}
+	if ls := running(); len(ls) != 0 {
+		t.Errorf("still running %+v", ls)
+	}
+	g.repeat.stop("", true)
+	expect := []string{"toggle e true []", "toggle e false []"}
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("unexpected input %q", in)
+	}
+
+	testRequest(h, http.MethodPost, "/macros/farm/toggle", "", "")
+	rq := httptest.NewRequest(http.MethodPost, "/client/release", nil)
+	g.releaseClient(httptest.NewRecorder(), rq)
+	if ls := running(); len(ls) != 0 {
+		t.Errorf("running after client release %+v", ls)
+	}
+	testRequest(h, http.MethodPost, "/macros/farm/toggle", "", "")
+	if err := g.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ls := running(); len(ls) != 0 {
+		t.Errorf("running after shutdown %+v", ls)
+	}
+}
+
+func TestEndToEnd_macroCooldown(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 0}
+(heal \{cooldown 1m} h)
+(walk \{group move} (wait 10m))
+(run \{group move} r)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _, h := testServer(t)
+	g.macros.replace([]*macroCfg{mset}, "")
+	if rrec := testRequest(h, http.MethodPost, "/macros/heal/run", "", ""); rrec.Code != http.StatusAccepted {
+		t.Fatalf("first run: %s", rrec.Result().Status)
+	}
+	rrec := testRequest(h, http.MethodPost, "/macros/heal/run", "", "")
+	if rrec.Code != http.StatusTooManyRequests {
+		t.Errorf("run during cooldown: %s", rrec.Result().Status)
+	}
+	if ra := rrec.Header().Get("Retry-After"); ra != "60" {
+		t.Errorf("unexpected Retry-After '%s'", ra)
+	}
+	rrec = testRequest(h, http.MethodPost, "/macros/walk/run", "", "")
+	if rrec.Code != http.StatusAccepted {
+		t.Fatalf("run walk: %s", rrec.Result().Status)
+	}
+	var walk macroJob
+	if err := json.NewDecoder(rrec.Body).Decode(&walk); err != nil {
+		t.Fatal(err)
+	}
+	if rrec := testRequest(h, http.MethodPost, "/macros/run/run", "", ""); rrec.Code != http.StatusConflict {
+		t.Errorf("run while group is busy: %s", rrec.Result().Status)
+	}
+	var cfg struct{ MacroState map[string]macroState }
+	rrec = httptest.NewRecorder()
+	g.handleConfig(rrec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if err := json.NewDecoder(rrec.Body).Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if st := cfg.MacroState["heal"]; st.Cooldown != 60000 || st.ReadyIn <= 59000 {
+		t.Errorf("unexpected heal state %+v", st)
+	}
+	if st := cfg.MacroState["run"]; st.Group != "move" || st.BlockedBy != "walk" {
+		t.Errorf("unexpected run state %+v", st)
+	}
+	g.inputs().cancel(walk.ID)
+	g.inputs().do(func() {})
+	if rrec := testRequest(h, http.MethodPost, "/macros/run/run", "", ""); rrec.Code != http.StatusAccepted {
+		t.Errorf("run after group is free: %s", rrec.Result().Status)
+	}
+}
+
+func TestEndToEnd_macroSets(t *testing.T) {
+	var sets []*macroCfg
+	for _, src := range []string{"(a (wait 50ms) x)", "(a y) (b z)"} {
+		mset, err := parseMacroSet(fmt.Sprintf("set%d", len(sets)+1), "test.xsx", []byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sets = append(sets, mset)
+	}
+	g, drv, h := testServer(t)
+	var notified []string
+	g.OnMacroSet = func(name string) { notified = append(notified, name) }
+	g.macros.replace(sets, "")
+	rrec := testRequest(h, http.MethodGet, "/macrosets", "", "")
+	if body := strings.TrimSpace(rrec.Body.String()); body != `{"Current":"set1","Sets":["set1","set2"]}` {
+		t.Errorf("unexpected macro sets %s", body)
+	}
+	if rrec := testRequest(h, http.MethodPost, "/macros/a/run", "", ""); rrec.Code != http.StatusAccepted {
+		t.Fatalf("run macro: %s", rrec.Result().Status)
+	}
+	rrec = testRequest(h, http.MethodPut, "/macrosets/current", "text/plain", "set2\n")
+	if rrec.Code != http.StatusNoContent {
+		t.Fatalf("switch macro set: %s", rrec.Result().Status)
+	}
+	if rrec := testRequest(h, http.MethodPost, "/macros/b/run", "", ""); rrec.Code != http.StatusAccepted {
+		t.Fatalf("run macro of new set: %s", rrec.Result().Status)
+	}
+	rrec = testRequest(h, http.MethodPut, "/macrosets/current", "text/plain", "nope")
+	if rrec.Code != http.StatusNotFound {
+		t.Errorf("switch to unknown macro set: %s", rrec.Result().Status)
+	}
+	g.inputs().do(func() {})
+	if in := drv.recorded(); !reflect.DeepEqual(in, []string{"tap x []", "tap z []"}) {
+		t.Errorf("unexpected input %q", in)
+	}
+	if !reflect.DeepEqual(notified, []string{"set2"}) {
+		t.Errorf("unexpected notifications %q", notified)
+	}
+}
+
+func TestEndToEnd_macroEdit(t *testing.T) {
+	g, _, h := testServer(t)
+	g.MacrosDir = t.TempDir()
+	rrec := testRequest(h, http.MethodPut, "/macros/game", "text/plain", "(a x)\n(b [\\press y])")
+	if rrec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("put broken macros: %s", rrec.Result().Status)
+	}
+	var merrs []map[string]interface{}
+	if err := json.NewDecoder(rrec.Body).Decode(&merrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(merrs) != 1 ||
+		merrs[0]["File"] != "game.xsx" ||
+		merrs[0]["Line"] != 2.0 || merrs[0]["Col"] != 5.0 {
+		t.Errorf("unexpected errors %v", merrs)
+	}
+	rrec = testRequest(h, http.MethodGet, "/macros/game", "", "")
+	if rrec.Code != http.StatusNotFound {
+		t.Errorf("get rejected macros: %s", rrec.Result().Status)
+	}
+	const src = "(a x)\n(b [\\tap y])\n"
+	rrec = testRequest(h, http.MethodPut, "/macros/game", "text/plain", src)
+	if rrec.Code != http.StatusNoContent {
+		t.Fatalf("put macros: %s", rrec.Result().Status)
+	}
+	if mset := g.macros.cur(); mset.name != "game" || len(mset.macros) != 2 {
+		t.Errorf("saved macros not loaded: %+v", mset)
+	}
+	rrec = testRequest(h, http.MethodGet, "/macros/game", "", "")
+	if rrec.Code != http.StatusOK || rrec.Body.String() != src {
+		t.Errorf("get macros: %s %q", rrec.Result().Status, rrec.Body.String())
+	}
+	rrec = testRequest(h, http.MethodPut, "/macros/.hidden", "text/plain", src)
+	if rrec.Code != http.StatusBadRequest {
+		t.Errorf("put to hidden file: %s", rrec.Result().Status)
+	}
+	rrec = testRequest(h, http.MethodPut, "/macros/record", "text/plain", src)
+	if rrec.Code != http.StatusBadRequest {
+		t.Errorf("put to reserved set: %s", rrec.Result().Status)
+	}
+	if err := os.WriteFile(filepath.Join(g.MacrosDir, "running.xsx"), []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if sets := loadMacroSets(g.MacrosDir, nil); len(sets) != 1 || sets[0].name != "game" {
+		t.Errorf("loaded reserved set: %+v", sets)
+	}
+	if err := os.Remove(filepath.Join(g.MacrosDir, "running.xsx")); err != nil {
+		t.Fatal(err)
+	}
+	rrec = testRequest(h, http.MethodDelete, "/macros/game", "", "")
+	if rrec.Code != http.StatusNoContent {
+		t.Fatalf("delete macros: %s", rrec.Result().Status)
+	}
+	if mset := g.macros.cur(); mset.name != "" {
+		t.Errorf("deleted macros still loaded: %+v", mset)
+	}
+	rrec = testRequest(h, http.MethodDelete, "/macros/game", "", "")
+	if rrec.Code != http.StatusNotFound {
+		t.Errorf("delete missing macros: %s", rrec.Result().Status)
+	}
+}
+
+func TestEndToEnd_macroRecord(t *testing.T) {
+	g, drv, h := testServer(t)
+	g.MacrosDir = t.TempDir()
+	const set = "(old x)"
+	if err := os.WriteFile(filepath.Join(g.MacrosDir, "game.xsx"), []byte(set), 0666); err != nil {
+		t.Fatal(err)
+	}
+	rrec := testRequest(h, http.MethodPost, "/macros/record", "application/json", `{"Live":true}`)
+	if rrec.Code != http.StatusCreated {
+		t.Fatalf("start recording: %s", rrec.Result().Status)
+	}
+	var session struct{ ID int }
+	if err := json.NewDecoder(rrec.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	finURL := fmt.Sprintf("/macros/record/%d/finish", session.ID)
+	rrec = testRequest(h, http.MethodPost, finURL, "application/json",
+		`{"Set":"game","Macro":"new"}`)
+	if rrec.Code != http.StatusBadRequest {
+		t.Errorf("finish recording without events: %s", rrec.Result().Status)
+	}
+	evURL := fmt.Sprintf("/macros/record/%d/events", session.ID)
+	rrec = testRequest(h, http.MethodPost, evURL, "application/json",
+		`[{"At":100,"Action":"tap","Key":"a"},{"At":150,"Action":"tap","Key":"b"}]`)
+	if rrec.Code != http.StatusAccepted {
+		t.Fatalf("post events: %s", rrec.Result().Status)
+	}
+	for i := 0; len(drv.recorded()) < 2; i++ {
+		if i > 100 {
+			t.Fatalf("events not replayed: %v", drv.recorded())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rrec = testRequest(h, http.MethodPost, evURL, "application/json",
+		`[{"At":120,"Action":"tap","Key":"c"}]`)
+	if rrec.Code != http.StatusBadRequest {
+		t.Errorf("post event back in time: %s", rrec.Result().Status)
+	}
+	rrec = testRequest(h, http.MethodPost, finURL, "application/json",
+		`{"Set":"game","Macro":"old"}`)
+	if rrec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("finish with duplicate name: %s", rrec.Result().Status)
+	}
+	rrec = testRequest(h, http.MethodPost, finURL, "application/json",
+		`{"Set":"game","Macro":"new"}`)
+	if rrec.Code != http.StatusCreated {
+		t.Fatalf("finish recording: %s", rrec.Result().Status)
+	}
+	const msrc = "(new \\{pause 0}\n  a\n  (wait 50ms)\n  b)\n"
+	if body := rrec.Body.String(); body != msrc {
+		t.Errorf("unexpected macro source %q", body)
+	}
+	src, err := os.ReadFile(filepath.Join(g.MacrosDir, "game.xsx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(src) != set+"\n"+msrc {
+		t.Errorf("unexpected set source %q", src)
+	}
+	if mset := g.macros.cur(); mset.find("new") < 0 {
+		t.Errorf("recorded macro not loaded: %+v", mset)
+	}
+	rrec = testRequest(h, http.MethodPost, finURL, "application/json",
+		`{"Set":"game","Macro":"again"}`)
+	if rrec.Code != http.StatusNotFound {
+		t.Errorf("finish finished recording: %s", rrec.Result().Status)
+	}
+}
+
+func TestEndToEnd_macroRecordConcurrent(t *testing.T) {
+	g, _, h := testServer(t)
+	g.MacrosDir = t.TempDir()
+	// Let the server cache the checked password before running concurrently
+	testRequest(h, http.MethodGet, "/macros/game", "", "")
+	const n = maxRecordSessions
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		s := g.record.start(false)
+		if _, _, err := g.record.add(s.ID, []RecordEvent{{Action: "tap", Key: "a"}}); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			rrec := testRequest(h, http.MethodPost,
+				fmt.Sprintf("/macros/record/%d/finish", id), "application/json",
+				fmt.Sprintf(`{"Set":"game","Macro":"m%d"}`, id))
+			if rrec.Code != http.StatusCreated {
+				t.Errorf("finish recording %d: %s", id, rrec.Result().Status)
+			}
+		}(s.ID)
+	}
+	wg.Wait()
+	if mset := g.macros.cur(); len(mset.macros) != n {
+		t.Errorf("expected %d recorded macros, have %d", n, len(mset.macros))
+	}
+}
+
+func TestEndToEnd_macroDebug(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 0}
+(greet \{params "who"} a "Hi $who" b)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, drv, h := testServer(t)
+	g.macros.replace([]*macroCfg{mset}, "")
+	rrec := testRequest(h, http.MethodPost, "/macros/greet/run?_break=3", "", "")
+	if rrec.Code != http.StatusBadRequest {
+		t.Errorf("breakpoint after last step: %s", rrec.Result().Status)
+	}
+	rrec = testRequest(h, http.MethodPost, "/macros/greet/run?_break=1&who=Bob", "", "")
+	if rrec.Code != http.StatusAccepted {
+		t.Fatalf("debug macro: %s", rrec.Result().Status)
+	}
+	var job macroJob
+	if err := json.NewDecoder(rrec.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	jobURL := fmt.Sprintf("/macros/jobs/%d", job.ID)
+	var st jobStatus
+	for i := 0; st.Debug == nil || !st.Debug.Paused; i++ {
+		if i > 100 {
+			t.Fatalf("macro not paused: %+v", st.Debug)
+		}
+		time.Sleep(5 * time.Millisecond)
+		rrec = testRequest(h, http.MethodGet, jobURL, "", "")
+		if rrec.Code != http.StatusOK {
+			t.Fatalf("job status: %s", rrec.Result().Status)
+		}
+		if err := json.NewDecoder(rrec.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st.Debug.Step != 1 || st.Debug.Kind != "type" || st.Debug.Pointer != [2]int{drv.x, drv.y} {
+		t.Errorf("unexpected debug status %+v", st.Debug)
+	}
+	if rrec = testRequest(h, http.MethodPost, jobURL+"/continue", "", ""); rrec.Code != http.StatusNoContent {
+		t.Fatalf("continue: %s", rrec.Result().Status)
+	}
+	g.inputs().do(func() {})
+	expect := []string{"tap a []", "type Hi Bob", "tap b []"}
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("unexpected input %q", in)
+	}
+	if rrec = testRequest(h, http.MethodPost, jobURL+"/step", "", ""); rrec.Code != http.StatusNotFound {
+		t.Errorf("step finished job: %s", rrec.Result().Status)
+	}
+}
+
+func TestEndToEnd_macroJobStatus(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 0}
+(inv (wait-window "^Inventory" 50ms) i)
+(ok x)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, drv, h := testServer(t)
+	g.macros.replace([]*macroCfg{mset}, "")
+	drv.setTitle("Chat")
+	status := func(name string) jobStatus {
+		t.Helper()
+		rrec := testRequest(h, http.MethodPost, "/macros/"+name+"/run", "", "")
+		if rrec.Code != http.StatusAccepted {
+			t.Fatalf("run %s: %s", name, rrec.Result().Status)
+		}
+		var job macroJob
+		if err := json.NewDecoder(rrec.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+		g.inputs().do(func() {})
+		rrec = testRequest(h, http.MethodGet, fmt.Sprintf("/macros/jobs/%d", job.ID), "", "")
+		if rrec.Code != http.StatusOK {
+			t.Fatalf("status of finished %s: %s", name, rrec.Result().Status)
+		}
+		var st jobStatus
+		if err := json.NewDecoder(rrec.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	st := status("inv")
+	if st.State != jobAborted ||
+		st.Error != "no window matching '^Inventory' within 50ms, active window is 'Chat'" {
+		t.Errorf("unexpected status of aborted macro %+v", st)
+	}
+	if st = status("ok"); st.State != jobDone || st.Error != "" {
+		t.Errorf("unexpected status of finished macro %+v", st)
+	}
+	if in := drv.recorded(); !reflect.DeepEqual(in, []string{"tap x []"}) {
+		t.Errorf("unexpected input %q", in)
+	}
+}
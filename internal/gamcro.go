@@ -9,6 +9,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"git.fractalqb.de/fractalqb/c4hgol"
 	"git.fractalqb.de/fractalqb/qbsllm"
@@ -36,6 +39,7 @@ const (
 )
 
 type Gamcro struct {
+	dataVersion     int64 // first for 64-bit alignment of atomic access
 	SrvAddr         string
 	Passphr         []byte `json:"-"`
 	TLSCert, TLSKey string
@@ -44,15 +48,54 @@ type Gamcro struct {
 	MultiClient     bool
 	ClientNet       string
 	TxtLimit        int
+	TypeDelay       time.Duration // default pause between typed characters
+	TypeHold        time.Duration // default time a key is held when typing
+	NewlinePolicy   TypePolicy    // default for newlines in typed text
+	TabPolicy       TypePolicy    // default for tabs in typed text
+	TypePolicies    TypePolicy    // policies clients may choose in addition
 	APIs            GamcroAPI
 	TextsDir        string
+	MacrosDir       string
+	MacroSet        string
 	CORS            string
+	Input           InputDriver       `json:"-"`
+	Clipboard       Clipboard         `json:"-"`
+	OnMacroSet      func(name string) `json:"-"`
+	inputOnce       sync.Once
+	input           *inputExec
+	macros          macroStore
+	texts           textStore
+	watch           fileWatch
+	repeat          repeaters
+	record          recorder
+	macrosMu        sync.Mutex // serializes changes to files in MacrosDir
+	srvMu           sync.Mutex
+	server          *http.Server
 }
 
 func (g *Gamcro) Run() error {
 	if g.TxtLimit <= 0 {
 		g.TxtLimit = 256
 	}
+	tm := typeTiming{delay: g.TypeDelay, hold: g.TypeHold}
+	if ctm := tm.clamp(); ctm != tm {
+		log.Warna("limit typing `delay` and `hold`", ctm.delay, ctm.hold)
+		g.TypeDelay, g.TypeHold = ctm.delay, ctm.hold
+	}
+	if g.NewlinePolicy == 0 {
+		g.NewlinePolicy = DropCtrl
+	}
+	if g.TabPolicy == 0 {
+		g.TabPolicy = DropCtrl
+	}
+	if g.Input == nil {
+		g.Input = RoboDriver{}
+	}
+	if g.Clipboard == nil {
+		g.Clipboard = SysClipboard{}
+	}
+	g.loadFiles()
+	go g.watchFiles(filePollInterval)
 	webRoutes := mux.NewRouter()
 	webRoutes.HandleFunc("/", handleUI)
 	if staticDir, err := fs.Sub(webfs, "webui"); err != nil {
@@ -133,28 +176,46 @@ func (g *Gamcro) listenAndServeTLS(handler http.Handler) error {
 			Certificates: []tls.Certificate{cert},
 		},
 	}
-	return server.ServeTLS(ln, "", "")
+	g.srvMu.Lock()
+	g.server = server
+	g.srvMu.Unlock()
+	if err = server.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
 func (g *Gamcro) handleConfig(wr http.ResponseWriter, rq *http.Request) {
+	mset := g.macros.cur()
 	cfg := struct {
 		Version     string
 		APIs        []string
 		MultiClient bool
+		DataVersion int64
 		MacroSet    string
 		Macros      []string
+		MacroParams map[string][]macroParam `json:",omitempty"`
+		MacroState  map[string]macroState   `json:",omitempty"`
 	}{
 		Version:     fmt.Sprintf("%d.%d.%d", Major, Minor, Patch),
+		DataVersion: atomic.LoadInt64(&g.dataVersion),
 		MultiClient: g.MultiClient,
-		MacroSet:    currentMacros.name,
+		MacroSet:    mset.name,
+		MacroState:  g.inputs().macroStates(mset),
 	}
 	for i := GamcroAPI(1); i < GamcroAPI_end; i <<= 1 {
 		if g.APIs.Active(i) {
 			cfg.APIs = append(cfg.APIs, i.String())
 		}
 	}
-	for _, m := range currentMacros.macros {
+	for _, m := range mset.macros {
 		cfg.Macros = append(cfg.Macros, m.name)
+		if len(m.params) > 0 {
+			if cfg.MacroParams == nil {
+				cfg.MacroParams = make(map[string][]macroParam)
+			}
+			cfg.MacroParams[m.name] = m.params
+		}
 	}
 	wr.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(wr)
@@ -13,7 +13,9 @@ func _() {
 	_ = x[ClipPostAPI-4]
 	_ = x[ClipGetAPI-8]
 	_ = x[SaveTexts-16]
-	_ = x[GamcroAPI_end-32]
+	_ = x[MacroAPI-32]
+	_ = x[MacroEditAPI-64]
+	_ = x[GamcroAPI_end-128]
 }
 
 const (
@@ -21,7 +23,9 @@ const (
 	_GamcroAPI_name_1 = "ClipPostAPI"
 	_GamcroAPI_name_2 = "ClipGetAPI"
 	_GamcroAPI_name_3 = "SaveTexts"
-	_GamcroAPI_name_4 = "GamcroAPI_end"
+	_GamcroAPI_name_4 = "MacroAPI"
+	_GamcroAPI_name_5 = "MacroEditAPI"
+	_GamcroAPI_name_6 = "GamcroAPI_end"
 )
 
 var (
@@ -41,6 +45,10 @@ func (i GamcroAPI) String() string {
 		return _GamcroAPI_name_3
 	case i == 32:
 		return _GamcroAPI_name_4
+	case i == 64:
+		return _GamcroAPI_name_5
+	case i == 128:
+		return _GamcroAPI_name_6
 	default:
 		return "GamcroAPI(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
@@ -0,0 +1,399 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const inputQueueLen = 32
+
+const (
+	// jobRetention is how long the status of a finished macro job is kept.
+	jobRetention = time.Minute
+	// maxFinishedJobs limits the number of finished macro jobs whose status
+	// is kept.
+	maxFinishedJobs = 64
+)
+
+var errInputQueueFull = errors.New("input queue is full")
+
+// cooldownError is returned when a macro is started again before its
+// cooldown is over.
+type cooldownError struct {
+	macro string
+	left  time.Duration
+}
+
+func (e cooldownError) Error() string {
+	return fmt.Sprintf("macro '%s' is cooling down for %s", e.macro, e.left)
+}
+
+// groupBusyError is returned when a macro is started while another macro of
+// the same group is queued or running.
+type groupBusyError struct {
+	group string
+	busy  string
+}
+
+func (e groupBusyError) Error() string {
+	return fmt.Sprintf("macro '%s' of group '%s' is running", e.busy, e.group)
+}
+
+// inputExec serializes all input to the desktop. Every robo API submits its
+// input as a job that is executed by a single goroutine. This keeps e.g.
+// keystrokes from concurrent requests from being interleaved.
+type inputExec struct {
+	drv      InputDriver
+	clip     Clipboard
+	texts    *textStore
+	txtLimit int
+	queue    chan func()
+	mu       sync.Mutex
+	jobs     map[int]*macroJob
+	finished map[int]finishedJob
+	lastID   int
+	started  map[string]time.Time
+}
+
+// newInputExec creates an inputExec that sends input to drv and clip. Macros
+// type stored texts from texts.
+func newInputExec(drv InputDriver, clip Clipboard, texts *textStore) *inputExec {
+	x := &inputExec{
+		drv:      drv,
+		clip:     clip,
+		texts:    texts,
+		queue:    make(chan func(), inputQueueLen),
+		jobs:     make(map[int]*macroJob),
+		finished: make(map[int]finishedJob),
+		started:  make(map[string]time.Time),
+	}
+	go x.loop()
+	return x
+}
+
+func (x *inputExec) loop() {
+	for job := range x.queue {
+		x.exec(job)
+	}
+}
+
+func (x *inputExec) exec(job func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errora("input job `panic`", p)
+		}
+	}()
+	job()
+}
+
+// do runs f with the input goroutine and waits until f is done.
+func (x *inputExec) do(f func()) {
+	done := make(chan struct{})
+	x.queue <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+}
+
+// macroJob is a macro that is queued or running in the input goroutine.
+type macroJob struct {
+	ID       int
+	Macro    string
+	group    string
+	cancel   context.CancelFunc
+	done     chan struct{}
+	released chan struct{}
+	release  sync.Once
+	debug    *macroDebug
+	state    string // guarded by inputExec.mu
+	err      error  // why the macro was aborted, guarded by inputExec.mu
+	stopped  bool   // cancelled by a client, guarded by inputExec.mu
+}
+
+// States of macro jobs as reported by GET /macros/jobs/{id}.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+	jobAborted   = "aborted"
+)
+
+// jobStatus is the state of a macro job. Error tells why an aborted macro
+// was stopped.
+type jobStatus struct {
+	ID    int
+	Macro string
+	State string
+	Error string      `json:",omitempty"`
+	Debug *debugState `json:",omitempty"`
+}
+
+type finishedJob struct {
+	jobStatus
+	at time.Time
+}
+
+// runMacro queues m for execution with the arguments args for the macro's
+// parameters and returns immediately. The returned job can be cancelled until
+// the macro is finished. Macros cannot be started during their cooldown or
+// while another macro of their group is queued or running.
+func (x *inputExec) runMacro(m *macro, args map[string]string) (*macroJob, error) {
+	return x.startMacro(m, args, nil)
+}
+
+// debugMacro queues m like runMacro for a step-through run by client. With
+// single set, the macro pauses before its first step. Otherwise it pauses at
+// the first step in breaks. The breakpoints must be checked with
+// checkBreaks.
+func (x *inputExec) debugMacro(m *macro, args map[string]string, single bool, breaks []int, client string) (*macroJob, error) {
+	d := newMacroDebug(m, single, breaks)
+	d.client = client
+	return x.startMacro(m, args, d)
+}
+
+func (x *inputExec) startMacro(m *macro, args map[string]string, debug *macroDebug) (*macroJob, error) {
+	now := time.Now()
+	x.mu.Lock()
+	left, busy := x.blocked(m, now)
+	switch {
+	case left > 0:
+		x.mu.Unlock()
+		return nil, cooldownError{macro: m.name, left: left}
+	case busy != "":
+		x.mu.Unlock()
+		return nil, groupBusyError{group: m.group, busy: busy}
+	}
+	prevStart, hadStart := x.started[m.name]
+	if m.cooldown > 0 {
+		x.started[m.name] = now
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	x.lastID++
+	job := &macroJob{
+		ID:       x.lastID,
+		Macro:    m.name,
+		group:    m.group,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		released: make(chan struct{}),
+		debug:    debug,
+		state:    jobQueued,
+	}
+	x.jobs[job.ID] = job
+	x.mu.Unlock()
+	run := func() {
+		defer x.finish(job)
+		if ctx.Err() != nil {
+			mlog.Debuga("skip cancelled macro `job`", job.ID)
+			return
+		}
+		x.mu.Lock()
+		job.state = jobRunning
+		x.mu.Unlock()
+		seed := time.Now().UnixNano()
+		mlog.Debuga("run `macro` `job` with `seed`", job.Macro, job.ID, seed)
+		r := newMacroRun(ctx, driverOut{x.drv, x.clip}, job.released, seed)
+		r.args = args
+		r.texts = x.texts
+		r.txtLimit = x.txtLimit
+		r.debug = debug
+		runMacro(m, r)
+		x.mu.Lock()
+		job.err = r.err
+		x.mu.Unlock()
+	}
+	select {
+	case x.queue <- run:
+		return job, nil
+	default:
+		job.cancel()
+		x.mu.Lock()
+		delete(x.jobs, job.ID)
+		if hadStart {
+			x.started[m.name] = prevStart
+		} else {
+			delete(x.started, m.name)
+		}
+		x.mu.Unlock()
+		return nil, errInputQueueFull
+	}
+}
+
+// blocked returns the time left until the cooldown of m is over and the name
+// of a queued or running macro of m's group. x.mu must be locked.
+func (x *inputExec) blocked(m *macro, now time.Time) (left time.Duration, busy string) {
+	if m.cooldown > 0 {
+		if t, ok := x.started[m.name]; ok {
+			left = t.Add(m.cooldown).Sub(now)
+		}
+	}
+	if m.group != "" {
+		for _, job := range x.jobs {
+			if job.group == m.group {
+				busy = job.Macro
+				break
+			}
+		}
+	}
+	return left, busy
+}
+
+// macroState is the state of a macro with a cooldown or a group that clients
+// use to show whether the macro can be started.
+type macroState struct {
+	Cooldown  float64 `json:",omitempty"` // milliseconds
+	Group     string  `json:",omitempty"`
+	ReadyIn   float64 `json:",omitempty"` // milliseconds until the cooldown is over
+	BlockedBy string  `json:",omitempty"` // running macro of the same group
+}
+
+// macroStates returns the states of all macros of mset that have a cooldown
+// or a group.
+func (x *inputExec) macroStates(mset *macroCfg) map[string]macroState {
+	now := time.Now()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var res map[string]macroState
+	for i := range mset.macros {
+		m := &mset.macros[i]
+		if m.cooldown <= 0 && m.group == "" {
+			continue
+		}
+		left, busy := x.blocked(m, now)
+		if left < 0 {
+			left = 0
+		}
+		if res == nil {
+			res = make(map[string]macroState)
+		}
+		res[m.name] = macroState{
+			Cooldown:  planMillis(m.cooldown),
+			Group:     m.group,
+			ReadyIn:   planMillis(left),
+			BlockedBy: busy,
+		}
+	}
+	return res
+}
+
+// finish removes job from the queued and running jobs and keeps its final
+// status for jobRetention.
+func (x *inputExec) finish(job *macroJob) {
+	job.cancel()
+	x.mu.Lock()
+	switch {
+	case job.err != nil:
+		job.state = jobAborted
+	case job.stopped:
+		job.state = jobCancelled
+	default:
+		job.state = jobDone
+	}
+	x.keep(x.jobStatus(job))
+	delete(x.jobs, job.ID)
+	x.mu.Unlock()
+	close(job.done)
+}
+
+// keep remembers the status of a finished job and forgets the statuses that
+// are older than jobRetention or exceed maxFinishedJobs. x.mu must be locked.
+func (x *inputExec) keep(st jobStatus) {
+	now := time.Now()
+	oldest := -1
+	for id, f := range x.finished {
+		if now.Sub(f.at) > jobRetention {
+			delete(x.finished, id)
+		} else if oldest < 0 || f.at.Before(x.finished[oldest].at) {
+			oldest = id
+		}
+	}
+	if len(x.finished) >= maxFinishedJobs {
+		delete(x.finished, oldest)
+	}
+	x.finished[st.ID] = finishedJob{jobStatus: st, at: now}
+}
+
+// jobStatus returns the current status of job. x.mu must be locked.
+func (x *inputExec) jobStatus(job *macroJob) jobStatus {
+	st := jobStatus{ID: job.ID, Macro: job.Macro, State: job.state}
+	if job.err != nil {
+		st.Error = job.err.Error()
+	}
+	if job.debug != nil {
+		st.Debug = job.debug.status()
+	}
+	return st
+}
+
+// status returns the status of the macro job with the given id and false if
+// there is no such job. Finished jobs are reported for jobRetention.
+func (x *inputExec) status(id int) (jobStatus, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if job := x.jobs[id]; job != nil {
+		return x.jobStatus(job), true
+	}
+	f, ok := x.finished[id]
+	if !ok || time.Since(f.at) > jobRetention {
+		return jobStatus{}, false
+	}
+	return f.jobStatus, true
+}
+
+// cancel stops the macro job with the given id. It returns false if there is
+// no such job, e.g. because the job is already finished.
+func (x *inputExec) cancel(id int) bool {
+	x.mu.Lock()
+	job := x.jobs[id]
+	x.mu.Unlock()
+	if job == nil {
+		return false
+	}
+	mlog.Infoa("cancel `macro` `job`", job.Macro, job.ID)
+	x.mu.Lock()
+	job.stopped = true
+	x.mu.Unlock()
+	job.cancel()
+	return true
+}
+
+// cancelAll stops all queued and running macro jobs.
+func (x *inputExec) cancelAll() {
+	x.mu.Lock()
+	ids := make([]int, 0, len(x.jobs))
+	for id := range x.jobs {
+		ids = append(ids, id)
+	}
+	x.mu.Unlock()
+	for _, id := range ids {
+		x.cancel(id)
+	}
+}
+
+// release ends the (while-held …) loops of the macro job with the given id.
+// The macro then continues with the steps after the loops. It returns false
+// if there is no such job.
+func (x *inputExec) release(id int) bool {
+	x.mu.Lock()
+	job := x.jobs[id]
+	x.mu.Unlock()
+	if job == nil {
+		return false
+	}
+	mlog.Debuga("release `macro` `job`", job.Macro, job.ID)
+	job.release.Do(func() { close(job.released) })
+	return true
+}
+
+func (g *Gamcro) inputs() *inputExec {
+	g.inputOnce.Do(func() {
+		g.input = newInputExec(g.Input, g.Clipboard, &g.texts)
+		g.input.txtLimit = g.TxtLimit
+	})
+	return g.input
+}
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInputExec_serial(t *testing.T) {
+	x := newInputExec(&recDriver{}, &recDriver{}, nil)
+	var active, overlaps int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			x.do(func() {
+				if atomic.AddInt32(&active, 1) > 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&active, -1)
+			})
+		}()
+	}
+	wg.Wait()
+	if overlaps > 0 {
+		t.Errorf("%d overlapping input jobs", overlaps)
+	}
+}
+
+func TestInputExec_cancel(t *testing.T) {
+	x := newInputExec(&recDriver{}, &recDriver{}, nil)
+	m := &macro{name: "long", steps: []macroStep{&stepWait{d: time.Hour}}}
+	running, err := x.runMacro(m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := x.runMacro(m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running.ID == queued.ID {
+		t.Fatal("jobs have same ID")
+	}
+	start := time.Now()
+	if !x.cancel(queued.ID) {
+		t.Error("cannot cancel queued job")
+	}
+	if !x.cancel(running.ID) {
+		t.Error("cannot cancel running job")
+	}
+	x.do(func() {})
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancel took %s", d)
+	}
+	if x.cancel(running.ID) {
+		t.Error("finished job still cancellable")
+	}
+	if x.cancel(queued.ID) {
+		t.Error("skipped job still cancellable")
+	}
+	if st, ok := x.status(running.ID); !ok || st.State != jobCancelled {
+		t.Errorf("unexpected status of cancelled job %+v", st)
+	}
+}
+
+func TestInputExec_release(t *testing.T) {
+	x := newInputExec(&recDriver{}, &recDriver{}, nil)
+	var done int32
+	m := &macro{name: "held", steps: []macroStep{
+		&stepRepeat{n: maxMacroRepeat, held: true, steps: []macroStep{
+			&stepWait{d: 10 * time.Millisecond},
+		}},
+		stepFunc(func(*macroRun) { atomic.StoreInt32(&done, 1) }),
+	}}
+	job, err := x.runMacro(m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !x.release(job.ID) {
+		t.Fatal("cannot release job")
+	}
+	x.do(func() {})
+	if atomic.LoadInt32(&done) == 0 {
+		t.Error("steps after while-held not played")
+	}
+	if x.release(job.ID) {
+		t.Error("finished job still releasable")
+	}
+}
+
+type stepFunc func(*macroRun)
+
+func (s stepFunc) play(r *macroRun) { s(r) }
+
+func TestInputExec_waitWindow(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 0}
+(m [\down Shift] (wait-window "^Inventory" 100ms) i)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mset.macros[0]
+	t.Run("match", func(t *testing.T) {
+		drv := &recDriver{}
+		x := newInputExec(drv, drv, nil)
+		if _, err := x.runMacro(m, nil); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		drv.setTitle("Inventory – Game")
+		x.do(func() {})
+		expect := []string{"toggle Shift true []", "tap i []"}
+		if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+			t.Errorf("unexpected input %q", in)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		drv := &recDriver{title: "Chat"}
+		x := newInputExec(drv, drv, nil)
+		start := time.Now()
+		if _, err := x.runMacro(m, nil); err != nil {
+			t.Fatal(err)
+		}
+		x.do(func() {})
+		if d := time.Since(start); d < 100*time.Millisecond {
+			t.Errorf("aborted after %s", d)
+		}
+		expect := []string{"toggle Shift true []", "toggle Shift false []"}
+		if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+			t.Errorf("unexpected input %q", in)
+		}
+	})
+}
+
+func TestInputExec_debug(t *testing.T) {
+	drv := &recDriver{}
+	x := newInputExec(drv, drv, nil)
+	m := &macro{name: "dbg", steps: []macroStep{
+		&stepTap{key: "a"},
+		&stepRepeat{n: 2, steps: []macroStep{&stepTap{key: "b"}}},
+		&stepTap{key: "c"},
+		&stepTap{key: "d"},
+	}}
+	job, err := x.debugMacro(m, nil, true, []int{3}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	await := func(step int) {
+		t.Helper()
+		for i := 0; ; i++ {
+			st, ok := x.status(job.ID)
+			if !ok {
+				t.Fatalf("job finished before step %d", step)
+			}
+			if st.Debug.Paused && st.Debug.Step == step {
+				return
+			}
+			if i > 100 {
+				t.Fatalf("not paused at step %d: %+v", step, st.Debug)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	await(0)
+	if in := drv.recorded(); len(in) != 0 {
+		t.Errorf("input before first step: %q", in)
+	}
+	if st, _ := x.status(job.ID); st.Debug.Kind != "tap" || st.Debug.Steps != 4 {
+		t.Errorf("unexpected status %+v", st.Debug)
+	}
+	if err := x.debugCont(job.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	await(1)
+	if err := x.debugCont(job.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	await(2)
+	expect := []string{"tap a []", "tap b []", "tap b []"}
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("unexpected input %q", in)
+	}
+	if err := x.debugCont(job.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	await(3)
+	if err := x.debugCont(job.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	<-job.done
+	expect = append(expect, "tap c []", "tap d []")
+	if in := drv.recorded(); !reflect.DeepEqual(in, expect) {
+		t.Errorf("unexpected input %q", in)
+	}
+	if err := x.debugCont(job.ID, true); err != errNoJob {
+		t.Errorf("continued finished job: %v", err)
+	}
+}
+
+func TestInputExec_debugCancel(t *testing.T) {
+	x := newInputExec(&recDriver{}, &recDriver{}, nil)
+	m := &macro{name: "dbg", steps: []macroStep{&stepTap{key: "a"}}}
+	job, err := x.debugMacro(m, nil, true, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := x.runMacro(m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.debugCont(plain.ID, true); err != errNotPaused {
+		t.Errorf("continued job without debugging: %v", err)
+	}
+	x.cancel(job.ID)
+	<-plain.done
+}
+
+func TestInputExec_debugIdle(t *testing.T) {
+	drv := &recDriver{}
+	x := newInputExec(drv, drv, nil)
+	m := &macro{name: "dbg", steps: []macroStep{&stepTap{key: "a"}}}
+	d := newMacroDebug(m, true, nil)
+	d.idle = 10 * time.Millisecond
+	job, err := x.startMacro(m, nil, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-job.done
+	st, _ := x.status(job.ID)
+	if st.State != jobAborted || st.Error == "" {
+		t.Errorf("idle macro not aborted: %+v", st)
+	}
+	if in := drv.recorded(); len(in) != 0 {
+		t.Errorf("input from aborted macro: %q", in)
+	}
+}
+
+func TestInputExec_cancelDebug(t *testing.T) {
+	x := newInputExec(&recDriver{}, &recDriver{}, nil)
+	m := &macro{name: "dbg", steps: []macroStep{&stepTap{key: "a"}}}
+	mine, err := x.debugMacro(m, nil, true, nil, "me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := x.debugMacro(m, nil, true, nil, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.cancelDebug("me")
+	<-mine.done
+	if st, _ := x.status(mine.ID); st.State != jobCancelled {
+		t.Errorf("debug job of released client: %+v", st)
+	}
+	if st, _ := x.status(other.ID); st.State == jobCancelled {
+		t.Errorf("cancelled debug job of other client")
+	}
+	x.cancelAll()
+	<-other.done
+	if st, _ := x.status(other.ID); st.State != jobCancelled {
+		t.Errorf("debug job after cancelling all jobs: %+v", st)
+	}
+}
@@ -1,198 +1,542 @@
 package internal
 
 import (
-	"reflect"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"git.fractalqb.de/fractalqb/qbsllm"
-	"git.fractalqb.de/fractalqb/xsx/gem"
-	"github.com/go-vgo/robotgo"
 )
 
 var (
 	mlog = qbsllm.New(qbsllm.Lnormal, "macro", nil, nil)
 )
 
+// macroPause is the default pause between macro steps. It can be set for a
+// macro set and for single macros with the 'pause' attribute.
 const macroPause = 50 * time.Millisecond
 
-func runMacro(m []gem.Expr) {
-	for _, step := range m {
+func runMacro(m *macro, r *macroRun) {
+	defer r.releaseOnCancel()
+	r.play(m)
+	if r.err != nil {
+		mlog.Errora("abort `macro`: `error`", m.name, r.err)
+	}
+}
+
+func (r *macroRun) play(m *macro) {
+	defer func(p time.Duration, h float64) { r.pause, r.human = p, h }(r.pause, r.human)
+	r.pause, r.human = m.pause, m.human
+	r.steps(m.steps)
+}
+
+func (r *macroRun) steps(steps []macroStep) {
+	r.depth++
+	defer func() { r.depth-- }()
+	for i, step := range steps {
+		if r.cancelled() {
+			return
+		}
+		if r.debug != nil && r.depth == 1 && !r.debug.before(r, i, step) {
+			return
+		}
 		mlog.Debuga("macro `step`", step)
-		switch s := step.(type) {
-		case *gem.Atom:
-			if s.Quoted() {
-				mlog.Tracea("type `string`", s.Txt)
-				robotgo.TypeStr(s.Txt)
-			} else {
-				mlog.Tracea("tap `key`", s.Txt)
-				robotgo.KeyTap(s.Txt)
-			}
-		case *gem.Sequence:
-			if s.Meta() {
-				mlog.Errora("macro has meta sequence", step)
-			} else {
-				switch s.Brace() {
-				case gem.Square:
-					playKey(s)
-				case gem.Curly:
-					playMouse(s)
-				case gem.Paren:
-					mlog.Errora("cannot hanlde paren sequence")
-				}
-			}
-		default:
-			mlog.Errora("unhandled `element type`", reflect.TypeOf(step))
+		step.play(r)
+		if _, ok := step.(*stepWait); !ok {
+			r.sleep(r.jitter(r.pause))
 		}
-		time.Sleep(macroPause) // TODO make it adjustable
 	}
 }
 
-func playKey(m *gem.Sequence) {
-	if len(m.Elems) == 0 {
-		mlog.Warns("empty key sequence in")
+// macroRun is the state of a single macro execution. It keeps track of keys
+// and mouse buttons that are held down so that they can be released when the
+// macro is cancelled.
+type macroRun struct {
+	ctx      context.Context
+	out      macroOut
+	released <-chan struct{}
+	args     map[string]string
+	texts    *textStore
+	txtLimit int // limits the characters of stored texts, 0 for no limit
+	rnd      *rand.Rand
+	pause    time.Duration
+	human    float64
+	err      error
+	debug    *macroDebug
+	depth    int // nesting of the steps being played
+	keys     map[string][]string
+	buttons  map[string]bool
+}
+
+// newMacroRun creates the state for a macro execution that sends its input to
+// out. Closing released ends all (while-held …) loops of the macro. The
+// random jitter of humanized macros is reproducible with the same seed.
+func newMacroRun(ctx context.Context, out macroOut, released <-chan struct{}, seed int64) *macroRun {
+	return &macroRun{
+		ctx:      ctx,
+		out:      out,
+		released: released,
+		rnd:      rand.New(rand.NewSource(seed)),
+		keys:     make(map[string][]string),
+		buttons:  make(map[string]bool),
+	}
+}
+
+// cancelled is true if the macro was cancelled or aborted.
+func (r *macroRun) cancelled() bool { return r.err != nil || r.ctx.Err() != nil }
+
+// abort stops the macro because of err.
+func (r *macroRun) abort(err error) { r.err = err }
+
+func (r *macroRun) isReleased() bool {
+	select {
+	case <-r.released:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d and returns false if the macro was cancelled meanwhile.
+func (r *macroRun) sleep(d time.Duration) bool {
+	if r.err != nil {
+		return false
+	}
+	return r.out.sleep(r.ctx, d)
+}
+
+// jitter randomly changes d by up to ±r.human·d if the current macro is
+// humanized.
+func (r *macroRun) jitter(d time.Duration) time.Duration {
+	if r.human <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration(r.human*float64(d)*(2*r.rnd.Float64()-1))
+}
+
+func (r *macroRun) keyDown(key string, mods []string) string {
+	res := r.out.KeyToggle(key, true, mods...)
+	if res == "" {
+		r.keys[key] = mods
+	}
+	return res
+}
+
+func (r *macroRun) keyUp(key string, mods []string) string {
+	delete(r.keys, key)
+	return r.out.KeyToggle(key, false, mods...)
+}
+
+func (r *macroRun) buttonToggle(action, button string) {
+	r.out.MouseToggle(action, button)
+	if action == "down" {
+		r.buttons[button] = true
+	} else {
+		delete(r.buttons, button)
+	}
+}
+
+func (r *macroRun) releaseOnCancel() {
+	if !r.cancelled() {
 		return
 	}
-	var cmd []string
-	action := 0
-	modsAt := 1
-	e := m.Elems[0].(*gem.Atom)
-	if e.Meta() {
-		switch e.Txt {
-		case "down":
-			action = -1
-			cmd = append(cmd, "down")
-		case "up":
-			action = 1
-			cmd = append(cmd, "up")
-		case "tap":
-			action = 0
-		default:
-			mlog.Errora("unknown `key action`", e.Txt)
-			return
+	for key, mods := range r.keys {
+		mlog.Debuga("release `key` of cancelled macro", key)
+		r.keyUp(key, mods)
+	}
+	for button := range r.buttons {
+		mlog.Debuga("release `mouse button` of cancelled macro", button)
+		r.buttonToggle("up", button)
+	}
+}
+
+// macroOut receives the input of a macro execution.
+type macroOut interface {
+	InputDriver
+	Clipboard
+	// sleep waits for d and returns false if ctx is done before.
+	sleep(ctx context.Context, d time.Duration) bool
+	// awaitWindow waits until the title of the active window matches re. It
+	// returns the last title and false if ctx is done or after timeout.
+	awaitWindow(ctx context.Context, re *regexp.Regexp, timeout time.Duration) (string, bool)
+}
+
+// driverOut sends macro input to an InputDriver and a Clipboard and sleeps
+// in real time.
+type driverOut struct {
+	InputDriver
+	Clipboard
+}
+
+func (driverOut) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// windowPoll is the interval in which driverOut.awaitWindow checks the title of
+// the active window.
+const windowPoll = 50 * time.Millisecond
+
+func (o driverOut) awaitWindow(ctx context.Context, re *regexp.Regexp, timeout time.Duration) (string, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		title := o.WindowTitle()
+		if re.MatchString(title) {
+			return title, true
 		}
-		if len(m.Elems) < 2 {
-			mlog.Errora("missing key spec in `key sequence`", m)
+		if !time.Now().Before(deadline) || !o.sleep(ctx, windowPoll) {
+			return title, false
 		}
-		cmd = append(cmd, m.Elems[1].(*gem.Atom).Txt)
-		modsAt = 2
+	}
+}
+
+// macroStep is a single, validated action of a compiled macro.
+type macroStep interface {
+	play(r *macroRun)
+}
+
+type stepTap struct {
+	key  string
+	mods []string
+}
+
+func (s *stepTap) play(r *macroRun) {
+	mlog.Tracea("tap `key` with `mods`", s.key, s.mods)
+	if res := r.out.KeyTap(s.key, s.mods...); res != "" {
+		mlog.Errora("tap `key`: `error`", s.key, res)
+	}
+}
+
+type stepToggle struct {
+	key  string
+	down bool
+	mods []string
+}
+
+func (s *stepToggle) play(r *macroRun) {
+	mlog.Tracea("toggle `key` `down` with `mods`", s.key, s.down, s.mods)
+	var res string
+	if s.down {
+		res = r.keyDown(s.key, s.mods)
 	} else {
-		cmd = append(cmd, e.Txt)
+		res = r.keyUp(s.key, s.mods)
 	}
-	for _, e := range m.Elems[modsAt:] {
-		cmd = append(cmd, e.(*gem.Atom).Txt)
+	if res != "" {
+		mlog.Errora("toggle `key`: `error`", s.key, res)
 	}
-	switch action {
-	case 0:
-		mods := make([]interface{}, len(cmd))
-		for i := range cmd {
-			mods[i] = cmd[i]
-		}
-		mlog.Tracea("tap `key` with `mods`", cmd[0], mods[1:])
-		robotgo.KeyTap(cmd[0], mods[1:]...)
-	default:
-		cmd[0], cmd[1] = cmd[1], cmd[0]
-		mlog.Tracea("toggle `key` with `mods`", cmd[0], cmd[1:])
-		robotgo.KeyToggle(cmd[0], cmd[1:]...)
-	}
-}
-
-func playMouse(m *gem.Sequence) {
-	for ip := 0; ip < len(m.Elems); ip++ {
-		switch m.Elems[ip].(*gem.Atom).Txt {
-		case "left":
-			ip++
-			mouseButton("left", m.Elems[ip].(*gem.Atom).Txt)
-		case "middle":
-			ip++
-			mouseButton("center", m.Elems[ip].(*gem.Atom).Txt)
-		case "right":
-			ip++
-			mouseButton("right", m.Elems[ip].(*gem.Atom).Txt)
-		case "click":
-			ip++
-			xk, yk := mouseCoos(
-				m.Elems[ip].(*gem.Atom).Txt,
-				m.Elems[ip+1].(*gem.Atom).Txt)
-			ip++
-			robotgo.MoveMouse(xk, yk)
-		case "drag":
-			ip++
-			xk, yk := mouseCoos(
-				m.Elems[ip].(*gem.Atom).Txt,
-				m.Elems[ip+1].(*gem.Atom).Txt)
-			ip++
-			robotgo.DragMouse(xk, yk)
-		case "scroll":
-			ip++
-			count, _ := strconv.ParseInt(m.Elems[ip].(*gem.Atom).Txt, 10, 32)
-			ip++
-			dir := m.Elems[ip].(*gem.Atom).Txt
-			robotgo.ScrollMouse(int(count), dir)
-		default:
-			mlog.Errora("unknown `mouse action`", m.Elems[ip].(*gem.Atom).Txt)
-		}
+}
+
+type stepHold struct {
+	key  string
+	mods []string
+	d    time.Duration
+}
+
+func (s *stepHold) play(r *macroRun) {
+	mlog.Tracea("hold `key` with `mods` for `duration`", s.key, s.mods, s.d)
+	if res := r.keyDown(s.key, s.mods); res != "" {
+		mlog.Errora("hold `key`: `error`", s.key, res)
+		return
+	}
+	if !r.sleep(r.jitter(s.d)) {
+		return
+	}
+	if res := r.keyUp(s.key, s.mods); res != "" {
+		mlog.Errora("release `key`: `error`", s.key, res)
 	}
 }
 
-func mouseCoos(xStr, yStr string) (x int, y int) {
-	xpf := strings.ContainsAny(xStr, "+-")
-	ypf := strings.ContainsAny(yStr, "+-")
-	if xpf || ypf {
-		x, y = robotgo.GetMousePos()
-		if xpf {
-			tmp, _ := strconv.ParseInt(xStr[1:], 10, 32)
-			if xStr[0] == '+' {
-				x += int(tmp)
-			} else {
-				x -= int(tmp)
-			}
-		} else {
-			tmp, _ := strconv.ParseInt(xStr, 10, 32)
-			x = int(tmp)
+type stepWait struct {
+	d time.Duration
+}
+
+func (s *stepWait) play(r *macroRun) {
+	mlog.Tracea("wait `duration`", s.d)
+	r.sleep(s.d)
+}
+
+// stepWaitWindow waits until the title of the active window matches re. The
+// macro is aborted if this does not happen within timeout.
+type stepWaitWindow struct {
+	re      *regexp.Regexp
+	timeout time.Duration
+}
+
+func (s *stepWaitWindow) play(r *macroRun) {
+	mlog.Tracea("wait for `window` `timeout`", s.re, s.timeout)
+	title, ok := r.out.awaitWindow(r.ctx, s.re, s.timeout)
+	if !ok && !r.cancelled() {
+		r.abort(fmt.Errorf("no window matching '%s' within %s, active window is '%s'",
+			s.re, s.timeout, title))
+	}
+}
+
+// stepRepeat plays its steps n times. With held set it also stops as soon as
+// the macro is released.
+type stepRepeat struct {
+	n     int
+	held  bool
+	steps []macroStep
+}
+
+func (s *stepRepeat) play(r *macroRun) {
+	mlog.Tracea("repeat `times` `while held`", s.n, s.held)
+	for i := 0; i < s.n; i++ {
+		if r.cancelled() || (s.held && r.isReleased()) {
+			return
 		}
-		if ypf {
-			tmp, _ := strconv.ParseInt(yStr[1:], 10, 32)
-			if yStr[0] == '+' {
-				y += int(tmp)
-			} else {
-				y -= int(tmp)
-			}
+		r.steps(s.steps)
+	}
+}
+
+type stepCall struct {
+	name string
+	m    *macro
+}
+
+func (s *stepCall) play(r *macroRun) {
+	mlog.Tracea("call `macro`", s.name)
+	r.play(s.m)
+}
+
+type stepType struct {
+	txt macroText
+}
+
+func (s *stepType) play(r *macroRun) {
+	txt := s.txt.expand(r.args)
+	mlog.Tracea("type `string`", txt)
+	r.out.TypeStr(txt)
+}
+
+// macroText is a text that may contain $name placeholders for the parameters
+// of a macro.
+type macroText []textPart
+
+// textPart is either a literal text or, if param is set, a placeholder.
+type textPart struct {
+	lit   string
+	param string
+}
+
+func (t macroText) expand(args map[string]string) string {
+	if len(t) == 1 && t[0].param == "" {
+		return t[0].lit
+	}
+	var sb strings.Builder
+	for _, p := range t {
+		if p.param == "" {
+			sb.WriteString(p.lit)
 		} else {
-			tmp, _ := strconv.ParseInt(yStr, 10, 32)
-			y = int(tmp)
-		}
-	} else {
-		px, err := strconv.ParseInt(xStr, 10, 32)
-		if err != nil {
-			mlog.Errora("parse mouse x-coo '%s'", xStr)
+			sb.WriteString(args[p.param])
 		}
-		py, err := strconv.ParseInt(yStr, 10, 32)
-		if err != nil {
-			mlog.Errora("parse mouse y-coo '%s'", yStr)
-		}
-		x = int(px)
-		y = int(py)
 	}
-	return x, y
+	return sb.String()
+}
+
+// stepText types entry idx of the stored text set.
+type stepText struct {
+	set string
+	idx int
 }
 
-func mouseButton(which string, action string) {
-	switch action {
+func (s *stepText) play(r *macroRun) {
+	var txts []string
+	if r.texts != nil {
+		txts, _ = r.texts.get(s.set)
+	}
+	if s.idx >= len(txts) {
+		r.abort(fmt.Errorf("no entry %d in text set '%s'", s.idx+1, s.set))
+		return
+	}
+	txt := cleanText(txts[s.idx])
+	if r.txtLimit > 0 && utf8.RuneCountInString(txt) > r.txtLimit {
+		r.abort(fmt.Errorf("entry %d of text set '%s' exceeds the text limit %d",
+			s.idx+1, s.set, r.txtLimit))
+		return
+	}
+	mlog.Tracea("type `entry` of `text set`", s.idx+1, s.set)
+	r.out.TypeStr(txt)
+}
+
+type stepClip struct {
+	txt macroText
+}
+
+func (s *stepClip) play(r *macroRun) {
+	txt := s.txt.expand(r.args)
+	mlog.Tracea("clip `string`", txt)
+	if err := r.out.WriteAll(txt); err != nil {
+		mlog.Errora("clip: `error`", err)
+	}
+}
+
+// pasteMods returns the modifiers of the platform's paste chord with key v.
+func pasteMods() []string {
+	if runtime.GOOS == "darwin" {
+		return []string{"cmd"}
+	}
+	return []string{"ctrl"}
+}
+
+type stepMouseButton struct {
+	button string
+	action string
+}
+
+func (s *stepMouseButton) play(r *macroRun) {
+	mlog.Tracea("`mouse button` `action`", s.button, s.action)
+	switch s.action {
 	case "click":
-		robotgo.MouseClick(which, false)
+		r.out.MouseClick(s.button, false)
 	case "double":
-		robotgo.MouseClick(which, true)
-	case "down":
-		robotgo.MouseToggle("down", which)
-	case "up":
-		robotgo.MouseToggle("up", which)
+		r.out.MouseClick(s.button, true)
 	default:
-		mlog.Errora("unknown `mouse-button action`", action)
+		r.buttonToggle(s.action, s.button)
 	}
 }
 
+// cooBase is what a mouse coordinate is relative to.
+type cooBase int
+
+const (
+	// cooScreen coordinates are pixels on the primary screen or, with pct
+	// set, percent of the screen size.
+	cooScreen cooBase = iota
+	// cooPointer coordinates are relative to the current pointer position.
+	cooPointer
+	// cooWindow coordinates are pixels relative to the active window's
+	// origin or, with pct set, percent of the window size.
+	cooWindow
+)
+
+// mouseCoo is a mouse coordinate. With param set, the coordinate is taken from
+// the macro parameter with that name when the macro is played.
+type mouseCoo struct {
+	base  cooBase
+	v     int
+	pct   bool
+	f     float64
+	param string
+}
+
+// parseMouseCoo parses mouse coordinates:
+//
+//	N     absolute pixels on the screen
+//	P%    percent of the screen size
+//	+N -N pixels relative to the pointer position
+//	w:N   pixels relative to the active window, N may be negative
+//	w:P%  percent of the active window's size
+func parseMouseCoo(s string) (res mouseCoo, err error) {
+	if strings.HasPrefix(s, "w:") {
+		res.base = cooWindow
+		s = s[2:]
+	} else if s != "" && (s[0] == '+' || s[0] == '-') {
+		res.base = cooPointer
+	}
+	if res.base != cooPointer && strings.HasSuffix(s, "%") {
+		res.pct = true
+		res.f, err = strconv.ParseFloat(s[:len(s)-1], 64)
+		if err == nil && (res.f < 0 || res.f > 100) {
+			err = fmt.Errorf("percentage %s not in range 0…100", s)
+		}
+		return res, err
+	}
+	res.v, err = strconv.Atoi(s)
+	return res, err
+}
+
+// at computes the coordinate in a frame with origin org and size size.
+func (c mouseCoo) at(org, size int) int {
+	if c.pct {
+		return org + int(math.Round(c.f*float64(size)/100))
+	}
+	return org + c.v
+}
+
+func (r *macroRun) coo(c mouseCoo) mouseCoo {
+	if c.param == "" {
+		return c
+	}
+	res, err := parseMouseCoo(r.args[c.param])
+	if err != nil {
+		mlog.Errora("mouse coordinate `param`: `error`", c.param, err)
+	}
+	return res
+}
+
+// frame returns origin and size of the area the coordinate c is relative to.
+func (r *macroRun) frame(c mouseCoo) (x, y, w, h int) {
+	switch c.base {
+	case cooPointer:
+		x, y = r.out.MousePos()
+	case cooWindow:
+		x, y, w, h = r.out.WindowBounds()
+	default:
+		if c.pct {
+			w, h = r.out.ScreenSize()
+		}
+	}
+	return x, y, w, h
+}
+
+func (r *macroRun) mousePos(x, y mouseCoo) (int, int) {
+	x, y = r.coo(x), r.coo(y)
+	fx, _, fw, _ := r.frame(x)
+	_, fy, _, fh := r.frame(y)
+	return x.at(fx, fw), y.at(fy, fh)
+}
+
+type stepMove struct {
+	x, y mouseCoo
+}
+
+func (s *stepMove) play(r *macroRun) {
+	x, y := r.mousePos(s.x, s.y)
+	mlog.Tracea("move mouse to `x` `y`", x, y)
+	if r.human > 0 {
+		r.out.MoveSmooth(x, y)
+	} else {
+		r.out.MoveMouse(x, y)
+	}
+}
+
+type stepDrag struct {
+	x, y mouseCoo
+}
+
+func (s *stepDrag) play(r *macroRun) {
+	x, y := r.mousePos(s.x, s.y)
+	mlog.Tracea("drag mouse to `x` `y`", x, y)
+	r.out.DragMouse(x, y)
+}
+
+type stepScroll struct {
+	count int
+	dir   string
+}
+
+func (s *stepScroll) play(r *macroRun) {
+	mlog.Tracea("scroll `count` `direction`", s.count, s.dir)
+	r.out.ScrollMouse(s.count, s.dir)
+}
+
 // func play2Proc(s *gem.Sequence) {
 // 	if len(s.Elems) > 0 {
 // 		// TODO: switching seems to not yet work?
@@ -208,19 +552,46 @@ func mouseButton(which string, action string) {
 // 	}
 // }
 
-var currentMacros macroCfg
-
 type macro struct {
-	name string
-	m    []gem.Expr
+	name     string
+	pause    time.Duration
+	human    float64
+	repeat   time.Duration
+	cooldown time.Duration
+	group    string
+	params   []macroParam
+	steps    []macroStep
+}
+
+// macroParam is a parameter that a macro declares with the \{params "…"}
+// attribute. The values of parameters used as mouse coordinates must be
+// coordinates.
+type macroParam struct {
+	Name       string
+	Coordinate bool `json:",omitempty"`
+}
+
+func (m *macro) param(name string) *macroParam {
+	for i := range m.params {
+		if m.params[i].Name == name {
+			return &m.params[i]
+		}
+	}
+	return nil
 }
 
 type macroCfg struct {
 	name   string
+	pause  time.Duration
+	human  float64
 	macros []macro
 }
 
-func (mcfg *macroCfg) run(i int) {
-	m := mcfg.macros[i] // TODO checks
-	runMacro(m.m)
+func (mcfg *macroCfg) find(name string) int {
+	for i := range mcfg.macros {
+		if mcfg.macros[i].name == name {
+			return i
+		}
+	}
+	return -1
 }
@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/gorilla/mux"
+)
+
+func (g *Gamcro) listMacros(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	mset := g.macros.cur()
+	log.Debuga("list macros of `set`", mset.name)
+	ls := []string{}
+	for _, m := range mset.macros {
+		ls = append(ls, m.name)
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(ls)
+}
+
+func (g *Gamcro) listMacroSets(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	log.Debugs("list macro sets")
+	ls := struct {
+		Current string
+		Sets    []string
+	}{
+		Current: g.macros.cur().name,
+		Sets:    []string{},
+	}
+	for _, s := range g.macros.all() {
+		ls.Sets = append(ls.Sets, s.name)
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(ls)
+}
+
+// handleMacroSetSwitch makes the macro set named in the request body the
+// current macro set.
+func (g *Gamcro) handleMacroSetSwitch(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	body, err := g.rqBody(wr, rq)
+	if httpError(wr, err, "read body") {
+		return
+	}
+	name := strings.TrimSpace(string(body))
+	if !g.switchMacroSet(name) {
+		log.Warna("no macro `set`", name)
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	}
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+// handleMacroRun queues a macro of the current set. The query parameters
+// _debug and _break start a step-through run, see debugQuery.
+func (g *Gamcro) handleMacroRun(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	name := mux.Vars(rq)["name"]
+	mset := g.macros.cur()
+	idx := mset.find(name)
+	if idx < 0 {
+		log.Warna("no `macro` in `set`", name, mset.name)
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	}
+	m := &mset.macros[idx]
+	single, breaks, err := debugQuery(rq)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args, err := g.macroArgs(wr, rq, m)
+	if err != nil {
+		log.Warna("`macro` arguments: `error`", name, err)
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var job *macroJob
+	if single || breaks != nil {
+		if err = checkBreaks(m, breaks); err != nil {
+			http.Error(wr, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err = g.inputs().debugMacro(m, args, single, breaks, clientHost(rq))
+	} else {
+		job, err = g.inputs().runMacro(m, args)
+	}
+	if err != nil {
+		log.Warna("cannot run `macro`: `error`", name, err)
+		runError(wr, err)
+		return
+	}
+	log.Infoa("run `macro` as `job`", name, job.ID)
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(wr).Encode(job)
+}
+
+// debugQuery reads the query parameters that start a macro for debugging.
+// With _debug=true the macro pauses before its first step, _break is a comma
+// separated list of step indices where the macro pauses. Both are removed
+// from the query so that they are not taken as macro arguments.
+func debugQuery(rq *http.Request) (single bool, breaks []int, err error) {
+	qry := rq.URL.Query()
+	if d := qry.Get("_debug"); d != "" {
+		if single, err = strconv.ParseBool(d); err != nil {
+			return false, nil, errors.New("invalid _debug flag")
+		}
+		qry.Del("_debug")
+	}
+	if b := qry.Get("_break"); b != "" {
+		for _, s := range strings.Split(b, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return false, nil, fmt.Errorf("invalid _break step '%s'", s)
+			}
+			breaks = append(breaks, i)
+		}
+		qry.Del("_break")
+	}
+	rq.URL.RawQuery = qry.Encode()
+	return single, breaks, nil
+}
+
+// runError responds with the status for an error from inputExec.runMacro.
+func runError(wr http.ResponseWriter, err error) {
+	switch err := err.(type) {
+	case cooldownError:
+		secs := int(math.Ceil(err.left.Seconds()))
+		wr.Header().Set("Retry-After", strconv.Itoa(secs))
+		http.Error(wr, err.Error(), http.StatusTooManyRequests)
+	case groupBusyError:
+		http.Error(wr, err.Error(), http.StatusConflict)
+	default:
+		http.Error(wr, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// handleMacroDryRun responds with the plan of a macro's execution without
+// sending any input. The query parameter _held sets the time after which
+// (while-held …) loops are released, default is DefaultPlanHeld. The query
+// parameter _seed reproduces the random timing of humanized macros.
+func (g *Gamcro) handleMacroDryRun(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	name := mux.Vars(rq)["name"]
+	mset := g.macros.cur()
+	idx := mset.find(name)
+	if idx < 0 {
+		log.Warna("no `macro` in `set`", name, mset.name)
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	}
+	held := DefaultPlanHeld
+	qry := rq.URL.Query()
+	if h := qry.Get("_held"); h != "" {
+		var err error
+		if held, err = time.ParseDuration(h); err != nil || held < 0 {
+			http.Error(wr, "invalid _held duration", http.StatusBadRequest)
+			return
+		}
+		qry.Del("_held")
+		rq.URL.RawQuery = qry.Encode()
+	}
+	seed := time.Now().UnixNano()
+	if s := qry.Get("_seed"); s != "" {
+		var err error
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(wr, "invalid _seed", http.StatusBadRequest)
+			return
+		}
+		qry.Del("_seed")
+		rq.URL.RawQuery = qry.Encode()
+	}
+	m := &mset.macros[idx]
+	args, err := g.macroArgs(wr, rq, m)
+	if err != nil {
+		log.Warna("`macro` arguments: `error`", name, err)
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	geo := driverGeometry(g.Input)
+	log.Infoa("dry-run `macro`", name)
+	plan := planMacro(m, args, &g.texts, held, geo, seed)
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(plan)
+}
+
+func (g *Gamcro) handleMacroCancel(wr http.ResponseWriter, rq *http.Request) {
+	g.macroJobOp(wr, rq, g.inputs().cancel)
+}
+
+func (g *Gamcro) handleMacroRelease(wr http.ResponseWriter, rq *http.Request) {
+	g.macroJobOp(wr, rq, g.inputs().release)
+}
+
+// handleMacroStep plays the next step of a paused macro job and pauses again.
+func (g *Gamcro) handleMacroStep(wr http.ResponseWriter, rq *http.Request) {
+	g.macroDebugOp(wr, rq, true)
+}
+
+// handleMacroContinue resumes a paused macro job until the next breakpoint.
+func (g *Gamcro) handleMacroContinue(wr http.ResponseWriter, rq *http.Request) {
+	g.macroDebugOp(wr, rq, false)
+}
+
+func (g *Gamcro) macroDebugOp(wr http.ResponseWriter, rq *http.Request, single bool) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(rq)["id"])
+	if err != nil {
+		http.Error(wr, "bad request", http.StatusBadRequest)
+		return
+	}
+	switch err := g.inputs().debugCont(id, single); err {
+	case nil:
+		wr.WriteHeader(http.StatusNoContent)
+	case errNoJob:
+		http.Error(wr, "not found", http.StatusNotFound)
+	default:
+		http.Error(wr, err.Error(), http.StatusConflict)
+	}
+}
+
+// getMacroJob responds with the status of a macro job. Finished jobs are
+// reported with their final state and, if the macro was aborted, the error
+// for jobRetention. For debugged jobs the status includes the current step
+// and the pointer position.
+func (g *Gamcro) getMacroJob(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(rq)["id"])
+	if err != nil {
+		http.Error(wr, "bad request", http.StatusBadRequest)
+		return
+	}
+	st, ok := g.inputs().status(id)
+	if !ok {
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(st)
+}
+
+func (g *Gamcro) macroJobOp(wr http.ResponseWriter, rq *http.Request, op func(int) bool) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(rq)["id"])
+	if err != nil {
+		http.Error(wr, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !op(id) {
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	}
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+// macroArgs reads the arguments for the parameters of m from a JSON object in
+// the request body or, without a JSON body, from the URL query. Text arguments
+// are cleaned and limited to g.TxtLimit characters.
+func (g *Gamcro) macroArgs(wr http.ResponseWriter, rq *http.Request, m *macro) (map[string]string, error) {
+	args := make(map[string]string)
+	mt, _, _ := mime.ParseMediaType(rq.Header.Get("Content-Type"))
+	if mt == "application/json" {
+		dec := json.NewDecoder(http.MaxBytesReader(wr, rq.Body, m.argsBodyLimit(g.TxtLimit)))
+		dec.UseNumber()
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil {
+			return nil, err
+		}
+		for k, v := range obj {
+			switch v := v.(type) {
+			case string:
+				args[k] = v
+			case json.Number:
+				args[k] = v.String()
+			default:
+				return nil, fmt.Errorf("argument '%s' is neither string nor number", k)
+			}
+		}
+	} else {
+		for k, vs := range rq.URL.Query() {
+			if len(vs) != 1 {
+				return nil, fmt.Errorf("argument '%s' given %d times", k, len(vs))
+			}
+			args[k] = vs[0]
+		}
+	}
+	if err := m.checkArgs(args, g.TxtLimit); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// maxJSONRune is the longest JSON encoding of a single character, i.e. an
+// escaped surrogate pair like \ud83d\ude00.
+const maxJSONRune = 12
+
+// argsBodyLimit returns the size of the largest JSON object with arguments
+// for the parameters of m that are within txtLimit, even if every character
+// is escaped.
+func (m *macro) argsBodyLimit(txtLimit int) int64 {
+	limit := int64(64) // braces and white space
+	for _, p := range m.params {
+		limit += maxJSONRune*int64(len(p.Name)+txtLimit) + 8 // quotes, colon and comma
+	}
+	return limit
+}
+
+// checkArgs validates the arguments for the parameters of m and cleans the
+// text arguments.
+func (m *macro) checkArgs(args map[string]string, txtLimit int) error {
+	if err := validation.Validate(args, m.argRules(txtLimit)); err != nil {
+		return err
+	}
+	for _, p := range m.params {
+		if !p.Coordinate {
+			args[p.Name] = cleanText(args[p.Name])
+		}
+	}
+	return nil
+}
+
+// argRules validates the arguments for the parameters of m. Coordinate
+// arguments are required, text arguments default to the empty string. A
+// txtLimit ≤ 0 does not limit the length of text arguments.
+func (m *macro) argRules(txtLimit int) validation.MapRule {
+	keys := make([]*validation.KeyRules, len(m.params))
+	for i, p := range m.params {
+		if p.Coordinate {
+			keys[i] = validation.Key(p.Name, validation.Required, validation.By(validMouseCoo))
+		} else if txtLimit > 0 {
+			keys[i] = validation.Key(p.Name, validation.RuneLength(0, txtLimit)).Optional()
+		} else {
+			keys[i] = validation.Key(p.Name).Optional()
+		}
+	}
+	return validation.Map(keys...)
+}
+
+func validMouseCoo(v interface{}) error {
+	if _, err := parseMouseCoo(v.(string)); err != nil {
+		return errors.New("must be a mouse coordinate")
+	}
+	return nil
+}
@@ -0,0 +1,719 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"git.fractalqb.de/fractalqb/xsx/gem"
+)
+
+// MacroErrors collects all errors found in a macro source.
+type MacroErrors []*MacroError
+
+func (mes MacroErrors) Error() string {
+	var sb strings.Builder
+	for i, e := range mes {
+		if i > 0 {
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(e.Error())
+	}
+	return sb.String()
+}
+
+// macroCompiler turns the GEM expressions of a macro into macroSteps. Errors
+// do not stop the compiler so that all errors of a macro can be reported.
+type macroCompiler struct {
+	file    string
+	macro   string
+	cur     *macro
+	pos     map[gem.Expr]srcPos
+	errs    MacroErrors
+	calls   []*macroCall
+	loops   int
+	weights map[string]int // largest product of nested loops per macro
+	anchors map[string]anchor
+}
+
+func (c *macroCompiler) errorf(at gem.Expr, format string, args ...interface{}) {
+	c.errs = append(c.errs, &MacroError{
+		File:   c.file,
+		Macro:  c.macro,
+		srcPos: c.pos[at],
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+// macroCall remembers where a (call name) step was compiled. Calls are
+// resolved when all macros of a set are compiled.
+type macroCall struct {
+	step  *stepCall
+	at    MacroError
+	loops int // product of the loops around the call
+}
+
+func (c *macroCall) errorf(format string, args ...interface{}) *MacroError {
+	res := c.at
+	res.Msg = fmt.Sprintf(format, args...)
+	return &res
+}
+
+func (c *macroCompiler) compile(m []gem.Expr) (steps []macroStep) {
+	for _, x := range m {
+		switch s := x.(type) {
+		case *gem.Atom:
+			switch {
+			case s.Meta():
+				c.errorf(s, "unexpected meta atom '%s'", s.Txt)
+			case s.Quoted():
+				steps = append(steps, &stepType{txt: c.text(s)})
+			default:
+				steps = append(steps, &stepTap{key: s.Txt})
+			}
+		case *gem.Sequence:
+			if s.Meta() {
+				c.errorf(s, "unexpected meta sequence")
+				continue
+			}
+			switch s.Brace() {
+			case gem.Square:
+				if step := c.keySeq(s); step != nil {
+					steps = append(steps, step)
+				}
+			case gem.Curly:
+				steps = append(steps, c.mouseSeq(s)...)
+			case gem.Paren:
+				if step := c.command(s); step != nil {
+					steps = append(steps, step)
+				}
+			default:
+				c.errorf(s, "cannot handle %s sequence", s.Brace())
+			}
+		default:
+			c.errorf(x, "unhandled element type %T", x)
+		}
+	}
+	return steps
+}
+
+func (c *macroCompiler) keyAtom(x gem.Expr) (string, bool) {
+	a, err := x.Atom(gem.NotMeta, gem.NotQuoted)
+	if err != nil {
+		c.errorf(x, "expect key name")
+		return "", false
+	}
+	return a.Txt, true
+}
+
+// keySeq compiles [key mod…], [\tap key mod…], [\down key mod…],
+// [\up key mod…] and [\hold duration key mod…].
+func (c *macroCompiler) keySeq(s *gem.Sequence) macroStep {
+	if len(s.Elems) == 0 {
+		c.errorf(s, "empty key sequence")
+		return nil
+	}
+	elms := s.Elems
+	action := "tap"
+	var hold time.Duration
+	if a, ok := elms[0].(*gem.Atom); ok && a.Meta() {
+		action = a.Txt
+		switch action {
+		case "tap", "down", "up":
+		case "hold":
+			if elms = elms[1:]; len(elms) == 0 {
+				c.errorf(s, "missing hold duration in key sequence")
+				return nil
+			}
+			if hold, ok = c.duration(elms[0]); !ok {
+				return nil
+			}
+		default:
+			c.errorf(a, "unknown key action '%s'", a.Txt)
+			return nil
+		}
+		if elms = elms[1:]; len(elms) == 0 {
+			c.errorf(s, "missing key in key sequence")
+			return nil
+		}
+	}
+	keys := make([]string, 0, len(elms))
+	ok := true
+	for _, e := range elms {
+		k, kok := c.keyAtom(e)
+		keys = append(keys, k)
+		ok = ok && kok
+	}
+	if !ok {
+		return nil
+	}
+	switch action {
+	case "tap":
+		return &stepTap{key: keys[0], mods: keys[1:]}
+	case "hold":
+		return &stepHold{key: keys[0], mods: keys[1:], d: hold}
+	}
+	return &stepToggle{key: keys[0], down: action == "down", mods: keys[1:]}
+}
+
+// command compiles paren sequences that start with a command name, e.g.
+// (wait 2s).
+func (c *macroCompiler) command(s *gem.Sequence) macroStep {
+	if len(s.Elems) == 0 {
+		c.errorf(s, "empty command")
+		return nil
+	}
+	cmd, err := s.Elems[0].Atom(gem.NotMeta, gem.NotQuoted)
+	if err != nil {
+		c.errorf(s.Elems[0], "expect command name")
+		return nil
+	}
+	args := s.Elems[1:]
+	switch cmd.Txt {
+	case "wait":
+		if len(args) != 1 {
+			c.errorf(s, "wait needs exactly one duration")
+			return nil
+		}
+		if d, ok := c.duration(args[0]); ok {
+			return &stepWait{d: d}
+		}
+	case "wait-window":
+		if len(args) != 2 {
+			c.errorf(s, "wait-window needs a title pattern and a timeout")
+			return nil
+		}
+		a, err := args[0].Atom(gem.NotMeta, gem.IgnQuoted)
+		if err != nil {
+			c.errorf(args[0], "expect title pattern")
+			return nil
+		}
+		re, err := regexp.Compile(a.Txt)
+		if err != nil {
+			c.errorf(a, "invalid title pattern: %s", err)
+			return nil
+		}
+		d, ok := c.duration(args[1])
+		if !ok {
+			return nil
+		}
+		if d == 0 {
+			c.errorf(args[1], "wait-window timeout must not be 0")
+			return nil
+		}
+		return &stepWaitWindow{re: re, timeout: d}
+	case "call":
+		if len(args) != 1 {
+			c.errorf(s, "call needs exactly one macro name")
+			return nil
+		}
+		name, err := args[0].Atom(gem.NotMeta, gem.NotQuoted)
+		if err != nil {
+			c.errorf(args[0], "expect macro name")
+			return nil
+		}
+		step := &stepCall{name: name.Txt}
+		c.calls = append(c.calls, &macroCall{
+			step:  step,
+			at:    MacroError{File: c.file, Macro: c.macro, srcPos: c.pos[s]},
+			loops: c.loops,
+		})
+		return step
+	case "repeat":
+		if len(args) < 2 {
+			c.errorf(s, "repeat needs a count and at least one step")
+			return nil
+		}
+		a, err := args[0].Atom(gem.NotMeta, gem.NotQuoted)
+		if err != nil {
+			c.errorf(args[0], "expect repeat count")
+			return nil
+		}
+		n, err := strconv.Atoi(a.Txt)
+		if err != nil || n < 1 || n > maxMacroRepeat {
+			c.errorf(a, "repeat count '%s' not in range 1…%d", a.Txt, maxMacroRepeat)
+			return nil
+		}
+		return c.loop(s, n, false, args[1:])
+	case "while-held":
+		if len(args) == 0 {
+			c.errorf(s, "while-held needs at least one step")
+			return nil
+		}
+		return c.loop(s, maxMacroRepeat, true, args)
+	case "text":
+		if len(args) != 2 {
+			c.errorf(s, "text needs a text set and an entry number")
+			return nil
+		}
+		set, err := args[0].Atom(gem.NotMeta, gem.IgnQuoted)
+		if err != nil || set.Txt == "" {
+			c.errorf(args[0], "expect text set name")
+			return nil
+		}
+		a, err := args[1].Atom(gem.NotMeta, gem.NotQuoted)
+		if err != nil {
+			c.errorf(args[1], "expect entry number")
+			return nil
+		}
+		n, err := strconv.Atoi(a.Txt)
+		if err != nil || n < 1 {
+			c.errorf(a, "invalid entry number '%s'", a.Txt)
+			return nil
+		}
+		return &stepText{set: set.Txt, idx: n - 1}
+	case "clip":
+		if len(args) != 1 {
+			c.errorf(s, "clip needs exactly one text")
+			return nil
+		}
+		a, err := args[0].Atom(gem.NotMeta, gem.IsQuoted)
+		if err != nil {
+			c.errorf(args[0], "expect quoted text")
+			return nil
+		}
+		return &stepClip{txt: c.text(a)}
+	case "paste":
+		if len(args) != 0 {
+			c.errorf(s, "paste has no arguments")
+			return nil
+		}
+		return &stepTap{key: "v", mods: pasteMods()}
+	case "include":
+		c.errorf(cmd, "include is only allowed outside of macros")
+	default:
+		c.errorf(cmd, "unknown command '%s'", cmd.Txt)
+	}
+	return nil
+}
+
+// maxMacroRepeat limits the number of iterations of loops. For nested loops
+// the product of the iterations must not exceed maxMacroRepeat, also when the
+// loops are nested by calls. A (while-held …) loop counts as maxMacroRepeat
+// iterations.
+const maxMacroRepeat = 1000
+
+func (c *macroCompiler) loop(s *gem.Sequence, n int, held bool, body []gem.Expr) macroStep {
+	outer := c.loops
+	if outer == 0 {
+		c.loops = n
+	} else if c.loops *= n; c.loops > maxMacroRepeat {
+		c.errorf(s, "nested loops exceed %d iterations", maxMacroRepeat)
+		c.loops = outer
+		return nil
+	}
+	if c.loops > c.weights[c.macro] {
+		if c.weights == nil {
+			c.weights = make(map[string]int)
+		}
+		c.weights[c.macro] = c.loops
+	}
+	steps := c.compile(body)
+	c.loops = outer
+	return &stepRepeat{n: n, held: held, steps: steps}
+}
+
+// maxMacroDuration limits all durations in macros, i.e. waits, pauses and key
+// hold times.
+const maxMacroDuration = 10 * time.Minute
+
+// duration parses Go durations like "1.5s" or "300ms". Plain integers are
+// milliseconds.
+func (c *macroCompiler) duration(x gem.Expr) (time.Duration, bool) {
+	a, err := x.Atom(gem.NotMeta, gem.NotQuoted)
+	if err != nil {
+		c.errorf(x, "expect duration")
+		return 0, false
+	}
+	var d time.Duration
+	if ms, err := strconv.Atoi(a.Txt); err == nil {
+		d = time.Duration(ms) * time.Millisecond
+	} else if d, err = time.ParseDuration(a.Txt); err != nil {
+		c.errorf(a, "invalid duration '%s'", a.Txt)
+		return 0, false
+	}
+	if d < 0 || d > maxMacroDuration {
+		c.errorf(a, "duration '%s' not in range 0…%s", a.Txt, maxMacroDuration)
+		return 0, false
+	}
+	return d, true
+}
+
+// attrs reads the key/value pairs of a meta attribute sequence
+// \{key value…}. Only the given keys are allowed.
+func (c *macroCompiler) attrs(s *gem.Sequence, keys ...string) map[string]*gem.Atom {
+	if s.Brace() != gem.Curly {
+		c.errorf(s, "attributes must be a curly sequence")
+		return nil
+	}
+	if len(s.Elems)%2 != 0 {
+		c.errorf(s, "attribute without value")
+		return nil
+	}
+	res := make(map[string]*gem.Atom)
+	for i := 0; i < len(s.Elems); i += 2 {
+		k, err := s.Elems[i].Atom(gem.NotMeta, gem.NotQuoted)
+		if err != nil {
+			c.errorf(s.Elems[i], "expect attribute name")
+			continue
+		}
+		known := false
+		for _, key := range keys {
+			if k.Txt == key {
+				known = true
+				break
+			}
+		}
+		if !known {
+			c.errorf(k, "unknown attribute '%s'", k.Txt)
+			continue
+		}
+		if _, dup := res[k.Txt]; dup {
+			c.errorf(k, "duplicate attribute '%s'", k.Txt)
+			continue
+		}
+		v, err := s.Elems[i+1].Atom(gem.NotMeta, gem.IgnQuoted)
+		if err != nil {
+			c.errorf(s.Elems[i+1], "expect attribute value")
+			continue
+		}
+		res[k.Txt] = v
+	}
+	return res
+}
+
+var mouseButtons = map[string]string{
+	"left":   "left",
+	"middle": "center",
+	"right":  "right",
+}
+
+// mouseSeq compiles a curly sequence of mouse actions, e.g.
+// {click 100 +20 left click scroll 3 down drag @inventory}.
+func (c *macroCompiler) mouseSeq(s *gem.Sequence) (steps []macroStep) {
+	elms := s.Elems
+	arg := func(i int, what string) (*gem.Atom, bool) {
+		if i >= len(elms) {
+			c.errorf(s, "missing %s for '%s'", what, elms[0].(*gem.Atom).Txt)
+			return nil, false
+		}
+		a, err := elms[i].Atom(gem.NotMeta, gem.NotQuoted)
+		if err != nil {
+			c.errorf(elms[i], "expect %s", what)
+			return nil, false
+		}
+		return a, true
+	}
+	for len(elms) > 0 {
+		act, err := elms[0].Atom(gem.NotMeta, gem.NotQuoted)
+		if err != nil {
+			c.errorf(elms[0], "expect mouse action")
+			return steps
+		}
+		switch act.Txt {
+		case "left", "middle", "right":
+			a, ok := arg(1, "button action")
+			if !ok {
+				return steps
+			}
+			switch a.Txt {
+			case "click", "double", "down", "up":
+				steps = append(steps, &stepMouseButton{
+					button: mouseButtons[act.Txt],
+					action: a.Txt,
+				})
+			default:
+				c.errorf(a, "unknown mouse button action '%s'", a.Txt)
+			}
+			elms = elms[2:]
+		case "click", "drag":
+			x, xok := arg(1, "x-coordinate or anchor")
+			if !xok {
+				return steps
+			}
+			var xc, yc mouseCoo
+			var yok bool
+			if strings.HasPrefix(x.Txt, "@") {
+				var an anchor
+				if an, xok = c.anchors[x.Txt[1:]]; !xok {
+					c.errorf(x, "unknown anchor '%s'", x.Txt[1:])
+				}
+				xc, yc, yok = an.x, an.y, xok
+				elms = elms[2:]
+			} else {
+				y, ok := arg(2, "y-coordinate")
+				if !ok {
+					return steps
+				}
+				xc, xok = c.mouseCoo(x)
+				yc, yok = c.mouseCoo(y)
+				elms = elms[3:]
+			}
+			if xok && yok {
+				if act.Txt == "click" {
+					steps = append(steps, &stepMove{x: xc, y: yc})
+				} else {
+					steps = append(steps, &stepDrag{x: xc, y: yc})
+				}
+			}
+		case "scroll":
+			n, ok := arg(1, "scroll count")
+			if !ok {
+				return steps
+			}
+			d, ok := arg(2, "scroll direction")
+			if !ok {
+				return steps
+			}
+			count, err := strconv.Atoi(n.Txt)
+			nok := err == nil && count >= 0
+			if !nok {
+				c.errorf(n, "scroll count '%s' is not a number", n.Txt)
+			}
+			switch d.Txt {
+			case "up", "down", "left", "right":
+				if nok {
+					steps = append(steps, &stepScroll{count: count, dir: d.Txt})
+				}
+			default:
+				c.errorf(d, "unknown scroll direction '%s'", d.Txt)
+			}
+			elms = elms[3:]
+		default:
+			c.errorf(act, "unknown mouse action '%s'", act.Txt)
+			return steps
+		}
+	}
+	return steps
+}
+
+// anchor is a named mouse position of a macro set.
+type anchor struct {
+	x, y mouseCoo
+}
+
+// anchor compiles the definition (anchor name x y) into c.anchors.
+func (c *macroCompiler) anchor(s *gem.Sequence) {
+	if len(s.Elems) != 4 {
+		c.errorf(s, "anchor needs a name and two coordinates")
+		return
+	}
+	name, err := s.Elems[1].Atom(gem.NotMeta, gem.NotQuoted)
+	if err != nil || paramNameLen(name.Txt) != len(name.Txt) {
+		c.errorf(s.Elems[1], "invalid anchor name")
+		return
+	}
+	if _, dup := c.anchors[name.Txt]; dup {
+		c.errorf(name, "duplicate anchor '%s'", name.Txt)
+		return
+	}
+	var an anchor
+	var xok, yok bool
+	if x, err := s.Elems[2].Atom(gem.NotMeta, gem.NotQuoted); err != nil {
+		c.errorf(s.Elems[2], "expect x-coordinate")
+	} else {
+		an.x, xok = c.mouseCoo(x)
+	}
+	if y, err := s.Elems[3].Atom(gem.NotMeta, gem.NotQuoted); err != nil {
+		c.errorf(s.Elems[3], "expect y-coordinate")
+	} else {
+		an.y, yok = c.mouseCoo(y)
+	}
+	if xok && yok {
+		if c.anchors == nil {
+			c.anchors = make(map[string]anchor)
+		}
+		c.anchors[name.Txt] = an
+	}
+}
+
+// mouseCoo compiles a mouse coordinate, see parseMouseCoo. A coordinate
+// "$name" is taken from the macro parameter name.
+func (c *macroCompiler) mouseCoo(a *gem.Atom) (res mouseCoo, ok bool) {
+	if strings.HasPrefix(a.Txt, "$") {
+		p := c.param(a, a.Txt[1:])
+		if p == nil {
+			return res, false
+		}
+		p.Coordinate = true
+		res.param = p.Name
+		return res, true
+	}
+	res, err := parseMouseCoo(a.Txt)
+	if err != nil {
+		c.errorf(a, "invalid mouse coordinate '%s'", a.Txt)
+		return res, false
+	}
+	return res, true
+}
+
+// text compiles the text of a quoted atom. In the text "$name" is a
+// placeholder for the macro parameter name and "$$" is a literal '$'. A '$'
+// that is not followed by a parameter name is taken literally.
+func (c *macroCompiler) text(a *gem.Atom) (res macroText) {
+	var lit strings.Builder
+	s := a.Txt
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			lit.WriteString(s)
+			break
+		}
+		lit.WriteString(s[:i])
+		s = s[i+1:]
+		if strings.HasPrefix(s, "$") {
+			lit.WriteByte('$')
+			s = s[1:]
+			continue
+		}
+		n := paramNameLen(s)
+		if n == 0 {
+			lit.WriteByte('$')
+			continue
+		}
+		name := s[:n]
+		s = s[n:]
+		if c.param(a, name) == nil {
+			continue
+		}
+		if lit.Len() > 0 {
+			res = append(res, textPart{lit: lit.String()})
+			lit.Reset()
+		}
+		res = append(res, textPart{param: name})
+	}
+	if lit.Len() > 0 || len(res) == 0 {
+		res = append(res, textPart{lit: lit.String()})
+	}
+	return res
+}
+
+// paramNameLen returns the length of the parameter name at the start of s.
+// Parameter names start with a letter followed by letters, digits or '_'.
+func paramNameLen(s string) int {
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch {
+		case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z':
+		case i > 0 && (b >= '0' && b <= '9' || b == '_'):
+		default:
+			return i
+		}
+	}
+	return len(s)
+}
+
+func (c *macroCompiler) param(at gem.Expr, name string) *macroParam {
+	var p *macroParam
+	if c.cur != nil {
+		p = c.cur.param(name)
+	}
+	if p == nil {
+		c.errorf(at, "undeclared parameter '%s'", name)
+	}
+	return p
+}
+
+// params reads the parameter names of the attribute \{params "name…"}. Names
+// are separated by white space or commas.
+func (c *macroCompiler) params(attrs map[string]*gem.Atom) (res []macroParam) {
+	a := attrs["params"]
+	if a == nil {
+		return nil
+	}
+	names := strings.FieldsFunc(a.Txt, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, name := range names {
+		if paramNameLen(name) != len(name) {
+			c.errorf(a, "invalid parameter name '%s'", name)
+			continue
+		}
+		dup := false
+		for _, p := range res {
+			dup = dup || p.Name == name
+		}
+		if dup {
+			c.errorf(a, "duplicate parameter '%s'", name)
+			continue
+		}
+		res = append(res, macroParam{Name: name})
+	}
+	return res
+}
+
+func (c *macroCompiler) pause(attrs map[string]*gem.Atom, dflt time.Duration) time.Duration {
+	if a := attrs["pause"]; a != nil {
+		if d, ok := c.duration(a); ok {
+			return d
+		}
+	}
+	return dflt
+}
+
+// repeat reads the 'repeat' attribute of a macro that is played again and
+// again when toggled, e.g. \{repeat 5s}. The interval is the time between
+// two runs.
+func (c *macroCompiler) repeat(attrs map[string]*gem.Atom) time.Duration {
+	a := attrs["repeat"]
+	if a == nil {
+		return 0
+	}
+	d, ok := c.duration(a)
+	if ok && d == 0 {
+		c.errorf(a, "repeat interval must not be 0")
+	}
+	return d
+}
+
+// cooldown reads the 'cooldown' attribute, the time after the start of a
+// macro during which it cannot be started again.
+func (c *macroCompiler) cooldown(attrs map[string]*gem.Atom) time.Duration {
+	if a := attrs["cooldown"]; a != nil {
+		d, _ := c.duration(a)
+		return d
+	}
+	return 0
+}
+
+// group reads the 'group' attribute. Only one macro of a group can run at a
+// time.
+func (c *macroCompiler) group(attrs map[string]*gem.Atom) string {
+	a := attrs["group"]
+	if a == nil {
+		return ""
+	}
+	if a.Txt == "" {
+		c.errorf(a, "empty group name")
+	}
+	return a.Txt
+}
+
+// maxHumanize is the maximal jitter of the 'humanize' attribute.
+const maxHumanize = 50
+
+// humanize reads the 'humanize' attribute, e.g. \{humanize 20%}. The value is
+// the maximal random deviation of pauses and key hold times in percent.
+// With 'off' or 0% timing is exact and mouse moves are instant.
+func (c *macroCompiler) humanize(attrs map[string]*gem.Atom, dflt float64) float64 {
+	a := attrs["humanize"]
+	if a == nil {
+		return dflt
+	}
+	if a.Txt == "off" {
+		return 0
+	}
+	if !strings.HasSuffix(a.Txt, "%") {
+		c.errorf(a, "humanize must be a percentage or 'off'")
+		return dflt
+	}
+	f, err := strconv.ParseFloat(a.Txt[:len(a.Txt)-1], 64)
+	if err != nil || f < 0 || f > maxHumanize {
+		c.errorf(a, "humanize '%s' not in range 0…%d%%", a.Txt, maxHumanize)
+		return dflt
+	}
+	return f / 100
+}
@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMacroCompile(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(m
+  x "Hi" [a Ctrl] [\down w] [\up w Shift]
+  {left click middle double right down click 10 20 drag +5 -5 scroll 3 up})`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []macroStep{
+		&stepTap{key: "x"},
+		&stepType{txt: macroText{{lit: "Hi"}}},
+		&stepTap{key: "a", mods: []string{"Ctrl"}},
+		&stepToggle{key: "w", down: true, mods: []string{}},
+		&stepToggle{key: "w", mods: []string{"Shift"}},
+		&stepMouseButton{button: "left", action: "click"},
+		&stepMouseButton{button: "center", action: "double"},
+		&stepMouseButton{button: "right", action: "down"},
+		&stepMove{x: mouseCoo{v: 10}, y: mouseCoo{v: 20}},
+		&stepDrag{x: mouseCoo{base: cooPointer, v: 5}, y: mouseCoo{base: cooPointer, v: -5}},
+		&stepScroll{count: 3, dir: "up"},
+	}
+	steps := mset.macros[0].steps
+	if len(steps) != len(expect) {
+		t.Fatalf("expect %d steps, got %d", len(expect), len(steps))
+	}
+	for i := range expect {
+		if !reflect.DeepEqual(steps[i], expect[i]) {
+			t.Errorf("step %d: expect %#v, got %#v", i, expect[i], steps[i])
+		}
+	}
+}
+
+func TestMacroCompile_errors(t *testing.T) {
+	_, err := parseMacroSet("test", "test.xsx", []byte(`(m1 [\press x] {click 10})
+(m2 {scroll many up} {jump} (foo))
+(m3 [a "b"] \x {right tap drag x 1})`))
+	if err == nil {
+		t.Fatal("no error")
+	}
+	merrs := err.(MacroErrors)
+	expect := []struct {
+		macro     string
+		line, col int
+	}{
+		{"m1", 1, 6},
+		{"m1", 1, 16},
+		{"m2", 2, 13},
+		{"m2", 2, 23},
+		{"m2", 2, 30},
+		{"m3", 3, 8},
+		{"m3", 3, 13},
+		{"m3", 3, 23},
+		{"m3", 3, 32},
+	}
+	if len(merrs) != len(expect) {
+		t.Fatalf("expect %d errors, got %d:\n%s", len(expect), len(merrs), err)
+	}
+	for i, e := range expect {
+		m := merrs[i]
+		if m.Macro != e.macro || m.Line != e.line || m.Col != e.col {
+			t.Errorf("error %d: expect %s@%d:%d, got %s", i, e.macro, e.line, e.col, m)
+		}
+	}
+}
+
+func TestMacroCompile_timing(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 80ms}
+(m1 (wait 2s) [\hold 1500ms w Shift])
+(m2 \{pause 0} x (wait 250))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mset.pause != 80*time.Millisecond {
+		t.Errorf("wrong set pause %s", mset.pause)
+	}
+	m1 := mset.macros[0]
+	if m1.pause != 80*time.Millisecond {
+		t.Errorf("wrong m1 pause %s", m1.pause)
+	}
+	expect := []macroStep{
+		&stepWait{d: 2 * time.Second},
+		&stepHold{key: "w", mods: []string{"Shift"}, d: 1500 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(m1.steps, expect) {
+		t.Errorf("unexpected m1 steps %#v", m1.steps)
+	}
+	m2 := mset.macros[1]
+	if m2.pause != 0 {
+		t.Errorf("wrong m2 pause %s", m2.pause)
+	}
+	if w := m2.steps[1].(*stepWait); w.d != 250*time.Millisecond {
+		t.Errorf("wrong m2 wait %s", w.d)
+	}
+}
+
+func TestMacroCompile_timingErrors(t *testing.T) {
+	_, err := parseMacroSet("test", "test.xsx", []byte(`\{pause soon}
+\{pause 1s}
+(m1 \{pause 1s delay 2s} (wait) (wait -1s) [\hold w] [\hold 1h w])`))
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if l := len(err.(MacroErrors)); l != 7 {
+		t.Errorf("expect 7 errors, got %d:\n%s", l, err)
+	}
+}
+
+func TestDefaultPause(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(m x)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mset.pause != macroPause || mset.macros[0].pause != macroPause {
+		t.Error("global default pause not used")
+	}
+}
+
+func TestMacroCompile_loops(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(
+		`(m (repeat 20 f (wait 300ms)) (while-held {scroll 1 down}) x)`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []macroStep{
+		&stepRepeat{n: 20, steps: []macroStep{
+			&stepTap{key: "f"},
+			&stepWait{d: 300 * time.Millisecond},
+		}},
+		&stepRepeat{n: maxMacroRepeat, held: true, steps: []macroStep{
+			&stepScroll{count: 1, dir: "down"},
+		}},
+		&stepTap{key: "x"},
+	}
+	if steps := mset.macros[0].steps; !reflect.DeepEqual(steps, expect) {
+		t.Errorf("unexpected steps %#v", steps)
+	}
+}
+
+func TestMacroCompile_loopErrors(t *testing.T) {
+	test := func(src string) {
+		t.Run(src, func(t *testing.T) {
+			_, err := parseMacroSet("test", "test.xsx", []byte(src))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if l := len(err.(MacroErrors)); l != 1 {
+				t.Errorf("expect 1 error, got %d:\n%s", l, err)
+			}
+		})
+	}
+	test("(m (repeat x))")
+	test("(m (repeat 0 x))")
+	test("(m (repeat 1001 x))")
+	test("(m (repeat many x))")
+	test("(m (while-held))")
+	test("(m (repeat 10 (repeat 200 x)))")
+	test("(m (while-held (repeat 2 x)))")
+	test("(m (repeat 10 (repeat 10 x) (repeat 11 (repeat 10 y))))")
+	test("(a (repeat 1000 (call b)))\n(b (repeat 1000 (call c)))\n(c x)")
+	test("(a (repeat 10 (call b)))\n(b (repeat 101 x))")
+	test("(a (repeat 2 (call b)))\n(b (call c))\n(c (while-held x))")
+	if _, err := parseMacroSet("test", "test.xsx", []byte(
+		"(a (repeat 10 (call b)) (call c))\n(b (repeat 100 x))\n(c (repeat 1000 (call d)))\n(d x)",
+	)); err != nil {
+		t.Errorf("rejected loops within limit: %s", err)
+	}
+}
+
+func TestMacroCompile_params(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(w \{params "player, msg"} "/w $player: $msg $$5 $1")
+(at \{params "x y dx"} {click $x $y drag $dx +0})
+(w2 \{params "player msg x y dx"} (call w) (call at))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &mset.macros[0]
+	txt := w.steps[0].(*stepType).txt
+	expect := macroText{
+		{lit: "/w "}, {param: "player"}, {lit: ": "}, {param: "msg"}, {lit: " $5 $1"},
+	}
+	if !reflect.DeepEqual(txt, expect) {
+		t.Errorf("unexpected text %#v", txt)
+	}
+	if s := txt.expand(map[string]string{"player": "Bob", "msg": "hi"}); s != "/w Bob: hi $5 $1" {
+		t.Errorf("wrong expansion '%s'", s)
+	}
+	for _, p := range mset.macros[2].params {
+		coo := p.Name == "x" || p.Name == "y" || p.Name == "dx"
+		if p.Coordinate != coo {
+			t.Errorf("parameter %s: coordinate is %t", p.Name, p.Coordinate)
+		}
+	}
+	move := mset.macros[1].steps[0].(*stepMove)
+	if move.x.param != "x" || move.y.param != "y" {
+		t.Errorf("unexpected move %#v", move)
+	}
+}
+
+func TestMacroCompile_paramErrors(t *testing.T) {
+	test := func(src string, errNo int) {
+		t.Run(src, func(t *testing.T) {
+			_, err := parseMacroSet("test", "test.xsx", []byte(src))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if l := len(err.(MacroErrors)); l != errNo {
+				t.Errorf("expect %d errors, got %d:\n%s", errNo, l, err)
+			}
+		})
+	}
+	test(`(m "$who")`, 1)
+	test(`(m \{params "a 1b a"} "$a")`, 2)
+	test(`(m \{params a} {click $a $b})`, 1)
+	test(`(m \{params a} (call n)) (n \{params "a b"} "$a$b")`, 1)
+}
+
+func TestParseMouseCoo(t *testing.T) {
+	test := func(s string, expect mouseCoo) {
+		t.Run(s, func(t *testing.T) {
+			c, err := parseMouseCoo(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c != expect {
+				t.Errorf("expect %+v, got %+v", expect, c)
+			}
+		})
+	}
+	test("10", mouseCoo{v: 10})
+	test("+0", mouseCoo{base: cooPointer})
+	test("-7", mouseCoo{base: cooPointer, v: -7})
+	test("50%", mouseCoo{pct: true, f: 50})
+	test("12.5%", mouseCoo{pct: true, f: 12.5})
+	test("w:-3", mouseCoo{base: cooWindow, v: -3})
+	test("w:100%", mouseCoo{base: cooWindow, pct: true, f: 100})
+	for _, s := range []string{"", "x", "+5%", "101%", "-1%", "w:", "w:x%", "v:5"} {
+		if _, err := parseMouseCoo(s); err == nil {
+			t.Errorf("no error for '%s'", s)
+		}
+	}
+}
+
+func TestMacroCompile_anchors(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(m {click @bag drag @bag})
+(anchor bag w:90% w:-20)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := mouseCoo{base: cooWindow, pct: true, f: 90}
+	y := mouseCoo{base: cooWindow, v: -20}
+	expect := []macroStep{&stepMove{x: x, y: y}, &stepDrag{x: x, y: y}}
+	if !reflect.DeepEqual(mset.macros[0].steps, expect) {
+		t.Errorf("unexpected steps %#v", mset.macros[0].steps)
+	}
+	_, err = parseMacroSet("test", "test.xsx", []byte(`(anchor a 1 2)
+(anchor a 3 4)
+(anchor b 5)
+(anchor $c 5 6)
+(anchor d 1 $x)
+(m {click @e left click})`))
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if l := len(err.(MacroErrors)); l != 5 {
+		t.Errorf("expect 5 errors, got %d:\n%s", l, err)
+	}
+}
+
+func TestMacroCompile_textsAndClip(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(m (text "my set" 1) (clip "x") (paste))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []macroStep{
+		&stepText{set: "my set", idx: 0},
+		&stepClip{txt: macroText{{lit: "x"}}},
+		&stepTap{key: "v", mods: pasteMods()},
+	}
+	if !reflect.DeepEqual(mset.macros[0].steps, expect) {
+		t.Errorf("unexpected steps %#v", mset.macros[0].steps)
+	}
+	_, err = parseMacroSet("test", "test.xsx", []byte(`(m (text a) (text a 0) (text a x)
+  (clip) (clip x) (paste v))`))
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if l := len(err.(MacroErrors)); l != 6 {
+		t.Errorf("expect 6 errors, got %d:\n%s", l, err)
+	}
+}
+
+func TestMacroCompile_humanize(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{humanize 10%}
+(m1 x) (m2 \{humanize off} x) (m3 \{humanize 2.5%} x)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range []float64{0.1, 0, 0.025} {
+		if mset.macros[i].human != h {
+			t.Errorf("%s: humanize %f, expect %f", mset.macros[i].name, mset.macros[i].human, h)
+		}
+	}
+	_, err = parseMacroSet("test", "test.xsx", []byte(`(m1 \{humanize 60%} x)
+(m2 \{humanize 10ms} x) (m3 \{humanize -1%} x)`))
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if l := len(err.(MacroErrors)); l != 3 {
+		t.Errorf("expect 3 errors, got %d:\n%s", l, err)
+	}
+}
+
+func TestMacroCompile_runAttrs(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(m \{repeat 2s cooldown 1500ms group "buffs"} x)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mset.macros[0]
+	if m.repeat != 2*time.Second || m.cooldown != 1500*time.Millisecond || m.group != "buffs" {
+		t.Errorf("unexpected attributes repeat=%s cooldown=%s group=%s", m.repeat, m.cooldown, m.group)
+	}
+	_, err = parseMacroSet("test", "test.xsx", []byte(`(m1 \{repeat 0} x)
+(m2 \{cooldown forever} x) (m3 \{group ""} x)`))
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if l := len(err.(MacroErrors)); l != 3 {
+		t.Errorf("expect 3 errors, got %d:\n%s", l, err)
+	}
+}
+
+func TestMacroCompile_waitWindow(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(m (wait-window "^Map" 2s))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := mset.macros[0].steps[0].(*stepWaitWindow)
+	if step.re.String() != "^Map" || step.timeout != 2*time.Second {
+		t.Errorf("unexpected step %+v", step)
+	}
+	_, err = parseMacroSet("test", "test.xsx", []byte(`(m (wait-window "Map")
+  (wait-window "(" 1s) (wait-window "Map" 0) (wait-window "Map" 1h))`))
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if l := len(err.(MacroErrors)); l != 4 {
+		t.Errorf("expect 4 errors, got %d:\n%s", l, err)
+	}
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugIdleTimeout is how long a debugged macro stays paused without the
+// client continuing it. Then the macro is aborted.
+const debugIdleTimeout = 5 * time.Minute
+
+// macroDebug lets a client step through the top-level steps of a macro job.
+// While the macro is paused, the input goroutine waits for the client. All
+// other input, e.g. from /keyboard/type, is queued until the macro
+// continues, is cancelled or was paused for longer than idle.
+type macroDebug struct {
+	client string // host of the client that started the macro
+	idle   time.Duration
+	mu     sync.Mutex
+	breaks map[int]bool
+	single bool          // pause before the next step
+	resume chan struct{} // closed to continue a paused macro, nil if running
+	state  debugState
+}
+
+// debugState is what the job status reports about a debugged macro.
+type debugState struct {
+	Step        int    // index of the current top-level step, starting at 0
+	Steps       int    // number of top-level steps
+	Kind        string // kind of the current step, e.g. "tap" or "wait"
+	Paused      bool   // paused before the current step
+	Breakpoints []int  `json:",omitempty"`
+	Pointer     [2]int // pointer position before the current step
+}
+
+// newMacroDebug creates the debugger for a run of m. With single set, the
+// macro pauses before its first step. Otherwise it runs until it reaches a
+// step in breaks.
+func newMacroDebug(m *macro, single bool, breaks []int) *macroDebug {
+	d := &macroDebug{
+		idle:   debugIdleTimeout,
+		breaks: make(map[int]bool),
+		single: single,
+		state:  debugState{Steps: len(m.steps)},
+	}
+	for _, b := range breaks {
+		if !d.breaks[b] {
+			d.breaks[b] = true
+			d.state.Breakpoints = append(d.state.Breakpoints, b)
+		}
+	}
+	sort.Ints(d.state.Breakpoints)
+	return d
+}
+
+// checkBreaks returns an error if a breakpoint is not a step index of m.
+func checkBreaks(m *macro, breaks []int) error {
+	for _, b := range breaks {
+		if b < 0 || b >= len(m.steps) {
+			return fmt.Errorf("breakpoint %d not in steps 0…%d of macro '%s'",
+				b, len(m.steps)-1, m.name)
+		}
+	}
+	return nil
+}
+
+// before is called before the top-level step with index i. It pauses if
+// needed and returns false if the macro was cancelled while paused or was
+// aborted because it was paused for longer than d.idle.
+func (d *macroDebug) before(r *macroRun, i int, step macroStep) bool {
+	x, y := r.out.MousePos()
+	kind := stepKind(step)
+	d.mu.Lock()
+	d.state.Step, d.state.Kind = i, kind
+	d.state.Pointer = [2]int{x, y}
+	if !d.single && !d.breaks[i] {
+		d.mu.Unlock()
+		return true
+	}
+	resume := make(chan struct{})
+	d.resume, d.state.Paused = resume, true
+	d.mu.Unlock()
+	mlog.Infoa("debug: pause before `step` `kind`", i, kind)
+	idle := time.NewTimer(d.idle)
+	defer idle.Stop()
+	select {
+	case <-resume:
+		return true
+	case <-r.ctx.Done():
+		d.mu.Lock()
+		d.resume, d.state.Paused = nil, false
+		d.mu.Unlock()
+		return false
+	case <-idle.C:
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.resume != resume {
+			return true // continued just in time
+		}
+		d.resume, d.state.Paused = nil, false
+		r.abort(fmt.Errorf("paused for more than %s", d.idle))
+		return false
+	}
+}
+
+var errNotPaused = errors.New("macro is not paused")
+
+// cont continues a paused macro. With single set, the macro pauses again
+// before its next top-level step, otherwise at the next breakpoint.
+func (d *macroDebug) cont(single bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.resume == nil {
+		return errNotPaused
+	}
+	d.single = single
+	close(d.resume)
+	d.resume, d.state.Paused = nil, false
+	return nil
+}
+
+func (d *macroDebug) status() *debugState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := d.state
+	return &s
+}
+
+// stepKind returns the kind of step derived from its type, e.g. "tap" for
+// *stepTap.
+func stepKind(step macroStep) string {
+	name := fmt.Sprintf("%T", step)
+	name = name[strings.LastIndexByte(name, '.')+1:]
+	return strings.ToLower(strings.TrimPrefix(name, "step"))
+}
+
+var errNoJob = errors.New("no such macro job")
+
+// debugCont continues the paused macro job with the given id, see
+// macroDebug.cont.
+func (x *inputExec) debugCont(id int, single bool) error {
+	x.mu.Lock()
+	job := x.jobs[id]
+	x.mu.Unlock()
+	switch {
+	case job == nil:
+		return errNoJob
+	case job.debug == nil:
+		return errNotPaused
+	}
+	mlog.Debuga("debug: continue `macro` `job` `single step`", job.Macro, job.ID, single)
+	return job.debug.cont(single)
+}
+
+// cancelDebug cancels all debugged macro jobs started by client.
+func (x *inputExec) cancelDebug(client string) {
+	x.mu.Lock()
+	var ids []int
+	for id, job := range x.jobs {
+		if job.debug != nil && job.debug.client == client {
+			ids = append(ids, id)
+		}
+	}
+	x.mu.Unlock()
+	for _, id := range ids {
+		x.cancel(id)
+	}
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxMacroSrc limits the size of macro sources uploaded with PUT /macros/{set}.
+const maxMacroSrc = 64 * 1024
+
+// reservedSetNames cannot be used as names of macro sets because the API
+// routes /macros/{set} of the macro sources would clash with other routes.
+var reservedSetNames = []string{"running", "record"}
+
+func reservedSetName(set string) bool {
+	for _, r := range reservedSetNames {
+		if set == r {
+			return true
+		}
+	}
+	return false
+}
+
+// macroSrcFile returns the file of the macro set in the request's URL. It
+// responds with an error and returns "" if the set name is not acceptable.
+func (g *Gamcro) macroSrcFile(wr http.ResponseWriter, rq *http.Request) (set, file string) {
+	set = mux.Vars(rq)["set"]
+	return set, g.macroSetFile(wr, set)
+}
+
+// macroSetFile returns the file of the macro set set. It responds with an
+// error and returns "" if the set name is not acceptable.
+func (g *Gamcro) macroSetFile(wr http.ResponseWriter, set string) string {
+	if dir, _ := filepath.Split(set); dir != "" ||
+		set == "" || len(set) > 64 ||
+		strings.HasPrefix(set, ".") {
+		log.Errora("tried to access macros at `path`", set)
+		http.Error(wr, "bad request", http.StatusBadRequest)
+		return ""
+	}
+	if reservedSetName(set) {
+		http.Error(wr, fmt.Sprintf("macro set name '%s' is reserved", set),
+			http.StatusBadRequest)
+		return ""
+	}
+	return filepath.Join(g.MacrosDir, set+MacroFileExt)
+}
+
+func (g *Gamcro) getMacroSrc(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroEditAPI, wr) {
+		return
+	}
+	set, file := g.macroSrcFile(wr, rq)
+	if file == "" {
+		return
+	}
+	log.Debuga("get source of macro `set`", set)
+	src, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	} else if httpError(wr, err, "read macro `file`", file) {
+		return
+	}
+	wr.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	wr.Write(src)
+}
+
+// putMacroSrc compiles the macro source from the request body and saves it as
+// macro set file only if there are no errors. Otherwise the errors with their
+// source positions are returned as JSON.
+func (g *Gamcro) putMacroSrc(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroEditAPI, wr) {
+		return
+	}
+	set, file := g.macroSrcFile(wr, rq)
+	if file == "" {
+		return
+	}
+	src, err := io.ReadAll(http.MaxBytesReader(wr, rq.Body, maxMacroSrc))
+	if err != nil {
+		log.Warna("read source of macro `set`: `error`", set, err)
+		http.Error(wr, "bad request", http.StatusBadRequest)
+		return
+	}
+	g.macrosMu.Lock()
+	defer g.macrosMu.Unlock()
+	if g.saveMacroSrc(wr, set, file, src) {
+		wr.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// saveMacroSrc saves src as the source of the macro set set in file and
+// reloads the macro sets. If src does not compile, the errors with their
+// source positions are sent as JSON and saveMacroSrc returns false. The
+// caller must hold g.macrosMu.
+func (g *Gamcro) saveMacroSrc(wr http.ResponseWriter, set, file string, src []byte) bool {
+	if _, err := parseMacroSet(set, file, src); err != nil {
+		log.Warna("reject source of macro `set`: `error`", set, err)
+		merrs, ok := err.(MacroErrors)
+		if !ok {
+			merrs = MacroErrors{&MacroError{File: file, Msg: err.Error()}}
+		}
+		for _, e := range merrs {
+			if rel, err := filepath.Rel(g.MacrosDir, e.File); err == nil {
+				e.File = filepath.ToSlash(rel)
+			}
+		}
+		wr.Header().Set("Content-Type", "application/json")
+		wr.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(wr).Encode(merrs)
+		return false
+	}
+	if err := os.MkdirAll(g.MacrosDir, 0777); httpError(wr, err, "create macros `dir`", g.MacrosDir) {
+		return false
+	}
+	tmpf := file + "~"
+	log.Infoa("save to `macro file`", file)
+	if err := os.WriteFile(tmpf, src, 0666); httpError(wr, err, "write `file`", tmpf) {
+		return false
+	}
+	if err := os.Rename(tmpf, file); httpError(wr, err, "rename `file`", tmpf) {
+		return false
+	}
+	g.loadMacros()
+	return true
+}
+
+func (g *Gamcro) deleteMacroSrc(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroEditAPI, wr) {
+		return
+	}
+	set, file := g.macroSrcFile(wr, rq)
+	if file == "" {
+		return
+	}
+	log.Infoa("delete macro `set`", set)
+	g.macrosMu.Lock()
+	defer g.macrosMu.Unlock()
+	err := os.Remove(file)
+	if os.IsNotExist(err) {
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	} else if httpError(wr, err, "delete macro `file`", file) {
+		return
+	}
+	g.loadMacros()
+	wr.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"bytes"
+
+	"git.fractalqb.de/fractalqb/xsx"
+	"git.fractalqb.de/fractalqb/xsx/gem"
+)
+
+// CheckMacroFile reads and compiles the macro set in file exactly like the
+// server does when it loads macro sets.
+func CheckMacroFile(file string) error {
+	_, err := readMacroSet(file)
+	return err
+}
+
+// FormatMacroSrc returns the macro source src in the canonical layout:
+// Top-level expressions are separated by empty lines, only consecutive
+// includes and consecutive anchors are kept together. Directives stay on one
+// line. Each step of a macro is on its own line and
+// the steps of loops are indented further.
+func FormatMacroSrc(file string, src []byte) ([]byte, error) {
+	exprs, _, err := parseMacroSrc(file, src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for i, x := range exprs {
+		if i > 0 {
+			buf.WriteByte('\n')
+			if !isDirective(x) || parenCmd(exprs[i-1]) != parenCmd(x) {
+				buf.WriteByte('\n')
+			}
+		}
+		if s, ok := x.(*gem.Sequence); ok && !s.Meta() && s.Brace() == gem.Paren && !isDirective(s) {
+			fmtBlock(&buf, s, 1, 1)
+		} else {
+			fmtExpr(&buf, x)
+		}
+	}
+	if len(exprs) > 0 {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// isDirective is true for the top-level expressions that are not macros,
+// i.e. include and anchor.
+func isDirective(x gem.Expr) bool {
+	switch parenCmd(x) {
+	case "include", "anchor":
+		return true
+	}
+	return false
+}
+
+// parenCmd returns the leading plain atom of a paren sequence or "".
+func parenCmd(x gem.Expr) string {
+	s, ok := x.(*gem.Sequence)
+	if !ok || s.Meta() || s.Brace() != gem.Paren || len(s.Elems) == 0 {
+		return ""
+	}
+	a, ok := s.Elems[0].(*gem.Atom)
+	if !ok || a.Meta() || a.Quoted() {
+		return ""
+	}
+	return a.Txt
+}
+
+const fmtIndent = "  "
+
+// fmtBlock writes the first head elements of s and a following meta sequence
+// on the first line. All other elements go on lines of their own with the
+// given indent level.
+func fmtBlock(buf *bytes.Buffer, s *gem.Sequence, head, indent int) {
+	buf.WriteByte('(')
+	elems := s.Elems
+	for i := 0; i < head && len(elems) > 0; i++ {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmtExpr(buf, elems[0])
+		elems = elems[1:]
+	}
+	if len(elems) > 0 {
+		if m, ok := elems[0].(*gem.Sequence); ok && m.Meta() {
+			buf.WriteByte(' ')
+			fmtExpr(buf, m)
+			elems = elems[1:]
+		}
+	}
+	for _, e := range elems {
+		buf.WriteByte('\n')
+		buf.Write(bytes.Repeat([]byte(fmtIndent), indent))
+		switch parenCmd(e) {
+		case "repeat":
+			fmtBlock(buf, e.(*gem.Sequence), 2, indent+1)
+		case "while-held":
+			fmtBlock(buf, e.(*gem.Sequence), 1, indent+1)
+		default:
+			fmtExpr(buf, e)
+		}
+	}
+	buf.WriteByte(')')
+}
+
+// fmtExpr writes x on a single line.
+func fmtExpr(buf *bytes.Buffer, x gem.Expr) {
+	switch x := x.(type) {
+	case *gem.Atom:
+		if x.Meta() {
+			buf.WriteByte('\\')
+		}
+		if x.Quoted() {
+			xsx.QuoteTo(x.Txt, buf)
+		} else {
+			buf.WriteString(x.Txt)
+		}
+	case *gem.Sequence:
+		if x.Meta() {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(x.Brace().Opening())
+		for i, e := range x.Elems {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			fmtExpr(buf, e)
+		}
+		buf.WriteRune(x.Brace().Closing())
+	}
+}
@@ -0,0 +1,48 @@
+package internal
+
+import "testing"
+
+func TestFormatMacroSrc(t *testing.T) {
+	src := `\{  pause 80ms }(include "a.xsx")
+(include "b.xsx") (anchor inv
+ 10 20)(anchor map 1 2)  (greet \{pause 0}"Hi \"you\""
+ [\down  Shift] {click +1 -2
+ left click}(repeat 3 x (while-held (wait 1s) y)))(empty)`
+	const expect = `\{pause 80ms}
+
+(include "a.xsx")
+(include "b.xsx")
+
+(anchor inv 10 20)
+(anchor map 1 2)
+
+(greet \{pause 0}
+  "Hi \"you\""
+  [\down Shift]
+  {click +1 -2 left click}
+  (repeat 3
+    x
+    (while-held
+      (wait 1s)
+      y)))
+
+(empty)
+`
+	res, err := FormatMacroSrc("test.xsx", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != expect {
+		t.Errorf("unexpected format:\n%s", res)
+	}
+	again, err := FormatMacroSrc("test.xsx", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != expect {
+		t.Errorf("format is not stable:\n%s", again)
+	}
+	if _, err := FormatMacroSrc("test.xsx", []byte("(a x")); err == nil {
+		t.Error("no error for broken source")
+	}
+}
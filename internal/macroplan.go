@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// DefaultPlanHeld is the time after which a dry run releases the
+// (while-held …) loops of a macro.
+const DefaultPlanHeld = time.Second
+
+// maxPlanActions limits the number of actions of a dry run. Longer plans are
+// truncated.
+const maxPlanActions = 10000
+
+// MacroPlan is the timeline of a macro's dry run. Times are milliseconds from
+// the start of the macro. The same Seed reproduces the random timing of
+// humanized macros. Error is the reason why the macro was aborted.
+type MacroPlan struct {
+	Macro     string
+	Seed      int64
+	Duration  float64
+	Truncated bool   `json:",omitempty"`
+	Error     string `json:",omitempty"`
+	Actions   []PlanAction
+}
+
+// PlanAction is a single input action of a MacroPlan that is planned at
+// time At.
+type PlanAction struct {
+	At     float64
+	Action string
+	Key    string   `json:",omitempty"`
+	Mods   []string `json:",omitempty"`
+	Text   string   `json:",omitempty"`
+	Button string   `json:",omitempty"`
+	Pos    []int    `json:",omitempty"`
+	Smooth bool     `json:",omitempty"`
+	Count  int      `json:",omitempty"`
+	Dir    string   `json:",omitempty"`
+}
+
+func planMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// planGeometry is the desktop geometry a dry run resolves mouse coordinates
+// with.
+type planGeometry struct {
+	x, y                   int // pointer position
+	scrW, scrH             int
+	winX, winY, winW, winH int
+}
+
+// defaultPlanGeometry is a full HD screen with the active window covering
+// the whole screen and the pointer at 0, 0.
+var defaultPlanGeometry = planGeometry{
+	scrW: 1920, scrH: 1080,
+	winW: 1920, winH: 1080,
+}
+
+// driverGeometry takes the current desktop geometry from drv.
+func driverGeometry(drv InputDriver) (geo planGeometry) {
+	geo.x, geo.y = drv.MousePos()
+	geo.scrW, geo.scrH = drv.ScreenSize()
+	geo.winX, geo.winY, geo.winW, geo.winH = drv.WindowBounds()
+	return geo
+}
+
+// planOut is the macroOut of a dry run. It records all input in a plan and
+// advances a virtual clock instead of sleeping.
+type planOut struct {
+	plan *MacroPlan
+	at   time.Duration
+	planGeometry
+	clip     string
+	held     time.Duration
+	released chan struct{}
+	cancel   context.CancelFunc
+}
+
+func (p *planOut) add(a PlanAction) {
+	if len(p.plan.Actions) >= maxPlanActions {
+		p.plan.Truncated = true
+		p.cancel()
+		return
+	}
+	a.At = planMillis(p.at)
+	p.plan.Actions = append(p.plan.Actions, a)
+}
+
+func (p *planOut) KeyTap(key string, mods ...string) string {
+	p.add(PlanAction{Action: "tap", Key: key, Mods: mods})
+	return ""
+}
+
+func (p *planOut) KeyToggle(key string, down bool, mods ...string) string {
+	act := "key-up"
+	if down {
+		act = "key-down"
+	}
+	p.add(PlanAction{Action: act, Key: key, Mods: mods})
+	return ""
+}
+
+func (p *planOut) TypeStr(txt string) {
+	p.add(PlanAction{Action: "type", Text: txt})
+}
+
+func (p *planOut) MouseClick(button string, double bool) {
+	act := "click"
+	if double {
+		act = "double-click"
+	}
+	p.add(PlanAction{Action: act, Button: button, Pos: []int{p.x, p.y}})
+}
+
+func (p *planOut) MouseToggle(action, button string) {
+	p.add(PlanAction{Action: "button-" + action, Button: button, Pos: []int{p.x, p.y}})
+}
+
+func (p *planOut) MousePos() (x, y int) { return p.x, p.y }
+
+func (p *planOut) ScreenSize() (w, h int) { return p.scrW, p.scrH }
+
+func (p *planOut) WindowBounds() (x, y, w, h int) {
+	return p.winX, p.winY, p.winW, p.winH
+}
+
+func (p *planOut) MoveMouse(x, y int) {
+	p.x, p.y = x, y
+	p.add(PlanAction{Action: "move", Pos: []int{x, y}})
+}
+
+func (p *planOut) MoveSmooth(x, y int) {
+	p.x, p.y = x, y
+	p.add(PlanAction{Action: "move", Pos: []int{x, y}, Smooth: true})
+}
+
+func (p *planOut) DragMouse(x, y int) {
+	p.x, p.y = x, y
+	p.add(PlanAction{Action: "drag", Pos: []int{x, y}})
+}
+
+func (p *planOut) ScrollMouse(count int, dir string) {
+	p.add(PlanAction{Action: "scroll", Count: count, Dir: dir})
+}
+
+// ReadAll returns the text that was put on the clipboard during the dry run.
+func (p *planOut) ReadAll() (string, error) { return p.clip, nil }
+
+func (p *planOut) WriteAll(txt string) error {
+	p.clip = txt
+	p.add(PlanAction{Action: "clip", Text: txt})
+	return nil
+}
+
+func (p *planOut) sleep(ctx context.Context, d time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if d > 0 {
+		p.at += d
+	}
+	p.checkHeld()
+	return true
+}
+
+// awaitWindow assumes that the expected window is active.
+func (p *planOut) awaitWindow(ctx context.Context, re *regexp.Regexp, timeout time.Duration) (string, bool) {
+	p.add(PlanAction{Action: "wait-window", Text: re.String()})
+	return "", ctx.Err() == nil
+}
+
+func (p *planOut) WindowTitle() string { return "" }
+
+func (p *planOut) checkHeld() {
+	select {
+	case <-p.released:
+	default:
+		if p.at >= p.held {
+			close(p.released)
+		}
+	}
+}
+
+// planMacro walks m with the arguments args like runMacro does but records
+// the input in a plan instead of sending it to the desktop. Mouse coordinates
+// are resolved with geo, stored texts are taken from texts and (while-held …)
+// loops are released after held. The jitter of humanized macros is computed
+// from seed.
+func planMacro(m *macro, args map[string]string, texts *textStore, held time.Duration, geo planGeometry, seed int64) *MacroPlan {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := &planOut{
+		plan:         &MacroPlan{Macro: m.name, Seed: seed, Actions: []PlanAction{}},
+		planGeometry: geo,
+		held:         held,
+		released:     make(chan struct{}),
+		cancel:       cancel,
+	}
+	out.checkHeld()
+	r := newMacroRun(ctx, out, out.released, seed)
+	r.args = args
+	r.texts = texts
+	runMacro(m, r)
+	if r.err != nil {
+		out.plan.Error = r.err.Error()
+	}
+	out.plan.Duration = planMillis(out.at)
+	return out.plan
+}
+
+// PlanMacroFile dry-runs the macro name of the macro set in file with the
+// arguments args for the macro's parameters. Mouse coordinates are resolved
+// for a 1920×1080 screen with the pointer at 0, 0 and the active window
+// covering the whole screen. Stored texts are read from textsDir. With seed 0
+// a random seed is used.
+func PlanMacroFile(file, name string, args map[string]string, textsDir string, held time.Duration, seed int64) (*MacroPlan, error) {
+	mset, err := readMacroSet(file)
+	if err != nil {
+		return nil, err
+	}
+	idx := mset.find(name)
+	if idx < 0 {
+		return nil, fmt.Errorf("no macro '%s' in '%s'", name, file)
+	}
+	m := &mset.macros[idx]
+	if err = m.checkArgs(args, 0); err != nil {
+		return nil, err
+	}
+	texts := &textStore{sets: loadTextSets(textsDir, nil)}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return planMacro(m, args, texts, held, defaultPlanGeometry, seed), nil
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanMacro(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 10ms}
+(m \{params "who x"}
+  [a Ctrl] (wait 1s) "hi $who" [\hold 200ms w]
+  {click $x +5 left click scroll 2 down}
+  (while-held {drag +1 +0}))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := planMacro(&mset.macros[0],
+		map[string]string{"who": "Bob", "x": "-10"},
+		nil,
+		1265*time.Millisecond,
+		planGeometry{x: 100, y: 200},
+		1,
+	)
+	expect := []PlanAction{
+		{At: 0, Action: "tap", Key: "a", Mods: []string{"Ctrl"}},
+		{At: 1010, Action: "type", Text: "hi Bob"},
+		{At: 1020, Action: "key-down", Key: "w", Mods: []string{}},
+		{At: 1220, Action: "key-up", Key: "w", Mods: []string{}},
+		{At: 1230, Action: "move", Pos: []int{90, 205}},
+		{At: 1240, Action: "click", Button: "left", Pos: []int{90, 205}},
+		{At: 1250, Action: "scroll", Count: 2, Dir: "down"},
+		{At: 1260, Action: "drag", Pos: []int{91, 205}},
+	}
+	if !reflect.DeepEqual(plan.Actions, expect) {
+		t.Errorf("unexpected plan:\n%+v", plan.Actions)
+	}
+	if plan.Duration != 1280 || plan.Truncated {
+		t.Errorf("duration %f, truncated %t", plan.Duration, plan.Truncated)
+	}
+}
+
+func TestPlanMacro_truncated(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(m (call n) (call n) (call n) (call n) (call n) (call n))
+(n (repeat 1000 [\down x] y))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := planMacro(&mset.macros[0], nil, nil, 0, defaultPlanGeometry, 1)
+	if !plan.Truncated {
+		t.Error("plan not truncated")
+	}
+	if l := len(plan.Actions); l != maxPlanActions {
+		t.Errorf("plan has %d actions", l)
+	}
+}
+
+func TestPlanMacro_geometry(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 0}
+(anchor ok w:50% w:-10)
+(m {click 25% 50% click w:10 w:20 click @ok click +5 w:100%})`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := planMacro(&mset.macros[0], nil, nil, 0, planGeometry{
+		x: 1, y: 2,
+		scrW: 800, scrH: 600,
+		winX: 100, winY: 50, winW: 200, winH: 100,
+	}, 1)
+	var pos [][]int
+	for _, a := range plan.Actions {
+		pos = append(pos, a.Pos)
+	}
+	expect := [][]int{{200, 300}, {110, 70}, {200, 40}, {205, 150}}
+	if !reflect.DeepEqual(pos, expect) {
+		t.Errorf("unexpected positions %v", pos)
+	}
+}
+
+func TestPlanMacro_texts(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 0}
+(m (text chat 1) (clip "gg") (text chat 2) (text none 1) (wait-window "^Chat$" 1s))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := &textStore{sets: map[string][]string{"chat": {"hi"}}}
+	plan := planMacro(&mset.macros[0], nil, texts, 0, defaultPlanGeometry, 1)
+	expect := []PlanAction{
+		{Action: "type", Text: "hi"},
+		{Action: "clip", Text: "gg"},
+	}
+	if !reflect.DeepEqual(plan.Actions, expect) {
+		t.Errorf("unexpected plan:\n%+v", plan.Actions)
+	}
+	if plan.Error != "no entry 2 in text set 'chat'" {
+		t.Errorf("unexpected error '%s'", plan.Error)
+	}
+}
+
+func TestPlanMacro_humanize(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`\{pause 100ms humanize 20%}
+(m a [\hold 1s b] {click 10 20} (call n) c)
+(n \{humanize off} x y)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mset.macros[0]
+	plan := planMacro(m, nil, nil, 0, defaultPlanGeometry, 42)
+	if !reflect.DeepEqual(plan, planMacro(m, nil, nil, 0, defaultPlanGeometry, 42)) {
+		t.Error("same seed gives different plans")
+	}
+	var last float64
+	for i, a := range plan.Actions {
+		d := a.At - last
+		last = a.At
+		switch {
+		case i == 0:
+		case a.Action == "key-up":
+			if d < 800 || d > 1200 {
+				t.Errorf("hold time %fms out of bounds", d)
+			}
+		case a.Key == "y":
+			if d != 100 {
+				t.Errorf("pause %fms in macro without humanize", d)
+			}
+		case a.Key == "c": // exact pause of n and pause of the call in m
+			if d < 180 || d > 220 {
+				t.Errorf("pause %fms after call out of bounds", d)
+			}
+		default:
+			if d < 80 || d > 120 {
+				t.Errorf("action %d: pause %fms out of bounds", i, d)
+			}
+		}
+	}
+	if mv := plan.Actions[3]; mv.Action != "move" || !mv.Smooth {
+		t.Errorf("expect smooth move, got %+v", mv)
+	}
+	if reflect.DeepEqual(plan, planMacro(m, nil, nil, 0, defaultPlanGeometry, 43)) {
+		t.Error("different seeds give the same plan")
+	}
+}
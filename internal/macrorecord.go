@@ -0,0 +1,410 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.fractalqb.de/fractalqb/xsx"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxRecordSessions limits the number of concurrent recording sessions.
+	// When a new session would exceed it, the oldest session is discarded.
+	maxRecordSessions = 4
+	// recordTimeout is the time after which an unfinished recording session
+	// is discarded.
+	recordTimeout = time.Hour
+)
+
+// RecordEvent is an input event captured by a client while recording a
+// macro. Its fields are those of PlanAction, At is the time of the event in
+// milliseconds on any clock of the client.
+type RecordEvent = PlanAction
+
+// recordSession collects the input events of a client for a new macro.
+type recordSession struct {
+	ID      int
+	Live    bool
+	created time.Time
+	events  []RecordEvent
+}
+
+// recorder holds the open recording sessions.
+type recorder struct {
+	mu       sync.Mutex
+	sessions map[int]*recordSession
+	lastID   int
+}
+
+func (rc *recorder) start(live bool) *recordSession {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := time.Now()
+	var oldest *recordSession
+	for id, s := range rc.sessions {
+		if now.Sub(s.created) > recordTimeout {
+			mlog.Infoa("discard stale recording `session`", id)
+			delete(rc.sessions, id)
+		} else if oldest == nil || s.created.Before(oldest.created) {
+			oldest = s
+		}
+	}
+	if len(rc.sessions) >= maxRecordSessions {
+		mlog.Warna("too many recordings, discard `session`", oldest.ID)
+		delete(rc.sessions, oldest.ID)
+	}
+	if rc.sessions == nil {
+		rc.sessions = make(map[int]*recordSession)
+	}
+	rc.lastID++
+	s := &recordSession{ID: rc.lastID, Live: live, created: now}
+	rc.sessions[s.ID] = s
+	return s
+}
+
+// add appends evs to the session id. It returns the index of the first new
+// event in the session.
+func (rc *recorder) add(id int, evs []RecordEvent) (live bool, from int, err error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	s := rc.sessions[id]
+	if s == nil {
+		return false, 0, errNoRecording
+	}
+	if len(s.events)+len(evs) > maxPlanActions {
+		return false, 0, fmt.Errorf("recording exceeds %d events", maxPlanActions)
+	}
+	last := 0.0
+	if len(s.events) > 0 {
+		last = s.events[len(s.events)-1].At
+	}
+	for i := range evs {
+		if evs[i].At < last {
+			return false, 0, fmt.Errorf("event %d: time %g before %g", i, evs[i].At, last)
+		}
+		last = evs[i].At
+		if _, err := recordStep(&evs[i]); err != nil {
+			return false, 0, fmt.Errorf("event %d: %s", i, err)
+		}
+	}
+	from = len(s.events)
+	s.events = append(s.events, evs...)
+	return s.Live, from, nil
+}
+
+// events returns the events of session id starting with event from. It
+// returns false if there is no session id.
+func (rc *recorder) events(id, from int) ([]RecordEvent, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	s := rc.sessions[id]
+	if s == nil {
+		return nil, false
+	}
+	if from < len(s.events) {
+		return s.events[from:len(s.events):len(s.events)], true
+	}
+	return nil, true
+}
+
+func (rc *recorder) remove(id int) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, ok := rc.sessions[id]; !ok {
+		return false
+	}
+	delete(rc.sessions, id)
+	return true
+}
+
+var errNoRecording = errors.New("no such recording")
+
+// recordStep returns the macro source of a single event.
+func recordStep(ev *RecordEvent) (string, error) {
+	key := func() (string, error) {
+		if ev.Key == "" {
+			return "", errors.New("missing key")
+		}
+		for _, k := range append([]string{ev.Key}, ev.Mods...) {
+			if xsx.NeedQuote(k) || strings.HasPrefix(k, `\`) {
+				return "", fmt.Errorf("unsupported key '%s'", k)
+			}
+		}
+		return strings.Join(append([]string{ev.Key}, ev.Mods...), " "), nil
+	}
+	button := func() (string, error) {
+		switch ev.Button {
+		case "", "left":
+			return "left", nil
+		case "middle", "center":
+			return "middle", nil
+		case "right":
+			return "right", nil
+		}
+		return "", fmt.Errorf("unknown mouse button '%s'", ev.Button)
+	}
+	pos := func() (string, error) {
+		if len(ev.Pos) != 2 || ev.Pos[0] < 0 || ev.Pos[1] < 0 {
+			return "", errors.New("expect mouse position [x y]")
+		}
+		return fmt.Sprintf("%d %d", ev.Pos[0], ev.Pos[1]), nil
+	}
+	switch ev.Action {
+	case "tap":
+		k, err := key()
+		if err != nil {
+			return "", err
+		}
+		if len(ev.Mods) == 0 {
+			return k, nil
+		}
+		return "[" + k + "]", nil
+	case "key-down", "key-up":
+		k, err := key()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(`[\%s %s]`, ev.Action[4:], k), nil
+	case "type":
+		if ev.Text == "" {
+			return "", errors.New("missing text")
+		}
+		return xsx.Quoted(strings.ReplaceAll(ev.Text, "$", "$$")), nil
+	case "click", "double-click", "button-down", "button-up":
+		b, err := button()
+		if err != nil {
+			return "", err
+		}
+		act := map[string]string{
+			"click":        "click",
+			"double-click": "double",
+			"button-down":  "down",
+			"button-up":    "up",
+		}[ev.Action]
+		if ev.Pos == nil {
+			return fmt.Sprintf("{%s %s}", b, act), nil
+		}
+		p, err := pos()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("{click %s %s %s}", p, b, act), nil
+	case "move", "drag":
+		p, err := pos()
+		if err != nil {
+			return "", err
+		}
+		if ev.Action == "move" {
+			return fmt.Sprintf("{click %s}", p), nil
+		}
+		return fmt.Sprintf("{drag %s}", p), nil
+	case "scroll":
+		switch ev.Dir {
+		case "up", "down", "left", "right":
+		default:
+			return "", fmt.Errorf("unknown scroll direction '%s'", ev.Dir)
+		}
+		if ev.Count <= 0 {
+			return "", errors.New("scroll count must be positive")
+		}
+		return fmt.Sprintf("{scroll %d %s}", ev.Count, ev.Dir), nil
+	}
+	return "", fmt.Errorf("unknown action '%s'", ev.Action)
+}
+
+// recordSource returns the source of macro name that replays evs with the
+// measured waits between the events. Waits are rounded to milliseconds and
+// capped at the maximal macro duration. The events must have been checked
+// with recordStep.
+func recordSource(name string, evs []RecordEvent) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "(%s \\{pause 0}", name)
+	for i := range evs {
+		if i > 0 {
+			ms := evs[i].At - evs[i-1].At
+			if max := planMillis(maxMacroDuration); ms > max {
+				ms = max
+			}
+			wait := time.Duration(math.Round(ms)) * time.Millisecond
+			if wait > 0 {
+				fmt.Fprintf(&sb, "\n  (wait %dms)", wait.Milliseconds())
+			}
+		}
+		step, _ := recordStep(&evs[i])
+		sb.WriteString("\n  ")
+		sb.WriteString(step)
+	}
+	sb.WriteString(")\n")
+	return sb.String()
+}
+
+func recordID(wr http.ResponseWriter, rq *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(rq)["id"])
+	if err != nil {
+		http.Error(wr, "bad recording id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// handleRecordStart opens a recording session. With {"Live":true} in the
+// request body, the recorded events are also played while recording, which
+// requires the MacroAPI.
+func (g *Gamcro) handleRecordStart(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroEditAPI, wr) {
+		return
+	}
+	var opts struct{ Live bool }
+	if rq.ContentLength != 0 {
+		err := json.NewDecoder(http.MaxBytesReader(wr, rq.Body, 1024)).Decode(&opts)
+		if err != nil {
+			http.Error(wr, "bad request", http.StatusBadRequest)
+			return
+		}
+	}
+	if opts.Live && !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	s := g.record.start(opts.Live)
+	log.Infoa("start recording `session` `live`", s.ID, s.Live)
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(http.StatusCreated)
+	json.NewEncoder(wr).Encode(s)
+}
+
+// handleRecordEvents adds the JSON array of events in the request body to
+// a recording session. The events' times must not decrease.
+func (g *Gamcro) handleRecordEvents(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroEditAPI, wr) {
+		return
+	}
+	id, ok := recordID(wr, rq)
+	if !ok {
+		return
+	}
+	var evs []RecordEvent
+	err := json.NewDecoder(http.MaxBytesReader(wr, rq.Body, maxMacroSrc)).Decode(&evs)
+	if err != nil {
+		http.Error(wr, "bad request", http.StatusBadRequest)
+		return
+	}
+	live, from, err := g.record.add(id, evs)
+	switch {
+	case err == errNoRecording:
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Warna("recording `session`: `error`", id, err)
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if live && len(evs) > 0 {
+		g.recordReplay(wr, id, from)
+		return
+	}
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+// recordReplay plays the events of session id starting with event from.
+func (g *Gamcro) recordReplay(wr http.ResponseWriter, id, from int) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	evs, _ := g.record.events(id, from)
+	src := recordSource("live", evs)
+	cfg, err := parseMacroSet("live", "record", []byte(src))
+	if httpError(wr, err, "compile recorded events of `session`", id) {
+		return
+	}
+	job, err := g.inputs().runMacro(&cfg.macros[0], nil)
+	if err != nil {
+		log.Warna("cannot replay recording `session`: `error`", id, err)
+		runError(wr, err)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(wr).Encode(job)
+}
+
+// handleRecordFinish turns the events of a recording session into a macro
+// and saves it to a macro set. The request body is {"Set":…,"Macro":…}. If
+// the set exists, the macro is appended to it. The response is the source
+// of the new macro.
+func (g *Gamcro) handleRecordFinish(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroEditAPI, wr) {
+		return
+	}
+	id, ok := recordID(wr, rq)
+	if !ok {
+		return
+	}
+	var target struct{ Set, Macro string }
+	err := json.NewDecoder(http.MaxBytesReader(wr, rq.Body, 1024)).Decode(&target)
+	if err != nil {
+		http.Error(wr, "bad request", http.StatusBadRequest)
+		return
+	}
+	if target.Macro == "" || xsx.NeedQuote(target.Macro) ||
+		strings.HasPrefix(target.Macro, `\`) {
+		http.Error(wr, "bad macro name", http.StatusBadRequest)
+		return
+	}
+	file := g.macroSetFile(wr, target.Set)
+	if file == "" {
+		return
+	}
+	g.macrosMu.Lock()
+	defer g.macrosMu.Unlock()
+	evs, ok := g.record.events(id, 0)
+	switch {
+	case !ok:
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	case len(evs) == 0:
+		http.Error(wr, "recording has no events", http.StatusBadRequest)
+		return
+	}
+	msrc := recordSource(target.Macro, evs)
+	src, err := os.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+	case httpError(wr, err, "read `macro file`", file):
+		return
+	case len(src) > 0 && src[len(src)-1] != '\n':
+		src = append(src, '\n')
+	}
+	src = append(src, msrc...)
+	if !g.saveMacroSrc(wr, target.Set, file, src) {
+		return
+	}
+	g.record.remove(id)
+	log.Infoa("recorded `macro` to `set`", target.Macro, target.Set)
+	wr.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	wr.WriteHeader(http.StatusCreated)
+	wr.Write([]byte(msrc))
+}
+
+func (g *Gamcro) handleRecordDiscard(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroEditAPI, wr) {
+		return
+	}
+	id, ok := recordID(wr, rq)
+	if !ok {
+		return
+	}
+	if !g.record.remove(id) {
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	}
+	wr.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package internal
+
+import "testing"
+
+func TestRecordSource(t *testing.T) {
+	evs := []RecordEvent{
+		{At: 1000, Action: "tap", Key: "a"},
+		{At: 1250, Action: "tap", Key: "s", Mods: []string{"ctrl"}},
+		{At: 1250, Action: "key-down", Key: "w"},
+		{At: 2000, Action: "key-up", Key: "w"},
+		{At: 2100, Action: "type", Text: "5 $"},
+		{At: 2100, Action: "click", Button: "left", Pos: []int{10, 20}},
+		{At: 2200, Action: "double-click", Button: "center"},
+		{At: 2300, Action: "button-down", Button: "right", Pos: []int{30, 40}},
+		{At: 2400, Action: "drag", Pos: []int{50, 60}},
+		{At: 2500, Action: "button-up", Button: "right"},
+		{At: 2500.6, Action: "move", Pos: []int{0, 0}},
+		{At: 1e300, Action: "scroll", Count: 3, Dir: "down"},
+	}
+	for i := range evs {
+		if _, err := recordStep(&evs[i]); err != nil {
+			t.Fatalf("event %d: %s", i, err)
+		}
+	}
+	src := recordSource("rec", evs)
+	const expect = `(rec \{pause 0}
+  a
+  (wait 250ms)
+  [s ctrl]
+  [\down w]
+  (wait 750ms)
+  [\up w]
+  (wait 100ms)
+  "5 $$"
+  {click 10 20 left click}
+  (wait 100ms)
+  {middle double}
+  (wait 100ms)
+  {click 30 40 right down}
+  (wait 100ms)
+  {drag 50 60}
+  (wait 100ms)
+  {right up}
+  (wait 1ms)
+  {click 0 0}
+  (wait 600000ms)
+  {scroll 3 down})
+`
+	if src != expect {
+		t.Errorf("unexpected source:\n%s", src)
+	}
+	if _, err := parseMacroSet("test", "test.xsx", []byte(src)); err != nil {
+		t.Error(err)
+	}
+	for _, ev := range []RecordEvent{
+		{Action: "tap"},
+		{Action: "tap", Key: "a b"},
+		{Action: "tap", Key: "a", Mods: []string{`\x`}},
+		{Action: "type"},
+		{Action: "click", Button: "fourth"},
+		{Action: "click", Pos: []int{1}},
+		{Action: "move"},
+		{Action: "scroll", Count: 1, Dir: "back"},
+		{Action: "scroll", Dir: "up"},
+		{Action: "jump"},
+	} {
+		if step, err := recordStep(&ev); err == nil {
+			t.Errorf("accepted %+v as %s", ev, step)
+		}
+	}
+}
@@ -0,0 +1,620 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"git.fractalqb.de/fractalqb/xsx"
+	"git.fractalqb.de/fractalqb/xsx/gem"
+)
+
+const (
+	DefaultMacrosDir = "macros"
+	MacroFileExt     = ".xsx"
+)
+
+type srcPos struct {
+	Line, Col int
+}
+
+func (p srcPos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// MacroError reports a problem in a macro source together with the file, the
+// macro and the position in the file where it was found.
+type MacroError struct {
+	File  string
+	Macro string `json:",omitempty"`
+	srcPos
+	Msg string
+}
+
+func (me *MacroError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(me.File)
+	if me.Line > 0 {
+		fmt.Fprintf(&sb, ":%s", me.srcPos)
+	}
+	if me.Macro != "" {
+		fmt.Fprintf(&sb, " macro '%s'", me.Macro)
+	}
+	sb.WriteString(": ")
+	sb.WriteString(me.Msg)
+	return sb.String()
+}
+
+// macroParser is an xsx.State that builds GEM expressions like gem.State does
+// but also records the source position of each expression.
+type macroParser struct {
+	res   []gem.Expr
+	ctx   []*gem.Sequence
+	pos   map[gem.Expr]srcPos
+	at    srcPos
+	start srcPos
+	inTok bool
+}
+
+func (p *macroParser) tokPos() (res srcPos) {
+	if p.inTok {
+		res = p.start
+		p.inTok = false
+	} else {
+		res = p.at
+	}
+	return res
+}
+
+func (p *macroParser) add(e gem.Expr) {
+	if len(p.ctx) == 0 {
+		p.res = append(p.res, e)
+	} else {
+		s := p.ctx[len(p.ctx)-1]
+		s.Elems = append(s.Elems, e)
+	}
+}
+
+func (p *macroParser) Begin(isMeta bool, brace byte) {
+	s := &gem.Sequence{}
+	s.SetMeta(isMeta)
+	s.SetBrace(gem.FromRune(brace))
+	p.pos[s] = p.tokPos()
+	p.add(s)
+	p.ctx = append(p.ctx, s)
+}
+
+func (p *macroParser) End(isMeta bool, brace byte) {
+	p.tokPos()
+	p.ctx = p.ctx[:len(p.ctx)-1]
+}
+
+func (p *macroParser) Atom(isMeta bool, atom []byte, quoted bool) {
+	a := &gem.Atom{Txt: string(atom)}
+	a.SetMeta(isMeta)
+	a.SetQuoted(quoted)
+	p.pos[a] = p.tokPos()
+	p.add(a)
+}
+
+// parseMacroSrc parses src into GEM expressions. The scanner is fed byte by
+// byte – quoted atoms as a whole – to know the line and column where each
+// expression starts.
+func parseMacroSrc(file string, src []byte) ([]gem.Expr, map[gem.Expr]srcPos, error) {
+	p := &macroParser{
+		pos: make(map[gem.Expr]srcPos),
+		at:  srcPos{Line: 1, Col: 1},
+	}
+	scn := xsx.NewParser(p)
+	for i := 0; i < len(src); {
+		b, end := src[i], i+1
+		if b == '"' {
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end < len(src) {
+				end++
+			}
+		}
+		if !p.inTok && !strings.ContainsRune(" \t\n\v\f\r", rune(b)) {
+			p.start, p.inTok = p.at, true
+		}
+		if err := scn.Scan(src[i:end]); err != nil {
+			return nil, nil, &MacroError{File: file, srcPos: p.at, Msg: scanErrMsg(err)}
+		}
+		for _, b := range src[i:end] {
+			switch {
+			case b == '\n':
+				p.at.Line++
+				p.at.Col = 1
+			case b&0xc0 != 0x80:
+				p.at.Col++
+			}
+		}
+		i = end
+	}
+	if err := scn.Finish(); err != nil {
+		return nil, nil, &MacroError{File: file, srcPos: p.at, Msg: scanErrMsg(err)}
+	}
+	return p.res, p.pos, nil
+}
+
+func scanErrMsg(err error) string {
+	if serr, ok := err.(*xsx.ScanError); ok {
+		return serr.Message()
+	}
+	return err.Error()
+}
+
+// readMacroSet reads a macro set from file. Each top-level expression in the
+// file must be a paren sequence that starts with the macro's name followed by
+// the macro's steps. Optional attributes for the whole set and for a single
+// macro are written as meta sequences. With \{humanize P%} pauses and key
+// hold times randomly deviate by up to P percent and mouse moves are smooth.
+// A macro with \{repeat interval} can be toggled to play again and again.
+// After the start of a macro with \{cooldown d} it cannot be started again
+// for d and of all macros with the same \{group name} only one can run at a
+// time. Macro definitions from other files can be included with
+// (include "file"), where file is relative to the including file. Named
+// mouse positions for the whole set are defined with (anchor name x y) and
+// used as {click @name}:
+//
+//	\{pause 80ms}
+//	(include "lib/chat.xsx")
+//	(anchor inventory w:90% w:50%)
+//	(greet \{pause 100ms} (call open-chat) "Hello" Enter)
+//	(farm \{repeat 30s humanize 10%} {click @inventory} (wait 2s) e)
+//	(whisper \{params "player msg"} (call open-chat) "/w $player $msg" Enter)
+func readMacroSet(file string) (*macroCfg, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(file)
+	name = name[:len(name)-len(filepath.Ext(name))]
+	if reservedSetName(name) {
+		return nil, MacroErrors{&MacroError{
+			File: file,
+			Msg:  fmt.Sprintf("macro set name '%s' is reserved, rename the file", name),
+		}}
+	}
+	return parseMacroSet(name, file, src)
+}
+
+const (
+	maxIncludeDepth = 8
+	maxCallDepth    = 16
+)
+
+// macroSetLoader reads a macro set file together with all files it includes
+// and compiles the macro definitions into a macroCfg.
+type macroSetLoader struct {
+	comp     macroCompiler
+	set      *macroCfg
+	root     string
+	files    []string
+	included map[string]bool
+	defs     []macroDef
+	anchors  []macroDef
+	attrs    bool
+}
+
+type macroDef struct {
+	file string
+	pos  map[gem.Expr]srcPos
+	def  *gem.Sequence
+}
+
+func parseMacroSet(name, file string, src []byte) (*macroCfg, error) {
+	file = filepath.Clean(file)
+	ld := macroSetLoader{
+		set:      &macroCfg{name: name, pause: macroPause},
+		root:     filepath.Dir(file),
+		included: make(map[string]bool),
+	}
+	ld.read(file, src)
+	ld.compile()
+	ld.resolveCalls()
+	if len(ld.comp.errs) > 0 {
+		return nil, ld.comp.errs
+	}
+	return ld.set, nil
+}
+
+func (ld *macroSetLoader) read(file string, src []byte) {
+	exprs, pos, err := parseMacroSrc(file, src)
+	if err != nil {
+		ld.comp.errs = append(ld.comp.errs, err.(*MacroError))
+		return
+	}
+	ld.files = append(ld.files, file)
+	ld.included[file] = true
+	defer func() { ld.files = ld.files[:len(ld.files)-1] }()
+	ld.comp.file, ld.comp.pos, ld.comp.macro = file, pos, ""
+	for _, x := range exprs {
+		if s, ok := x.(*gem.Sequence); ok && s.Meta() {
+			switch {
+			case len(ld.files) > 1:
+				ld.comp.errorf(s, "set attributes not allowed in included file")
+			case ld.attrs:
+				ld.comp.errorf(s, "duplicate set attributes")
+			default:
+				ld.attrs = true
+				attrs := ld.comp.attrs(s, "pause", "humanize")
+				ld.set.pause = ld.comp.pause(attrs, ld.set.pause)
+				ld.set.human = ld.comp.humanize(attrs, ld.set.human)
+			}
+			continue
+		}
+		def, err := x.Seq(gem.NotMeta, gem.Paren)
+		if err != nil {
+			ld.comp.errorf(x, "expect macro definition '(name step…)'")
+			continue
+		}
+		switch parenCmd(def) {
+		case "include":
+			ld.include(def)
+			ld.comp.file, ld.comp.pos, ld.comp.macro = file, pos, ""
+		case "anchor":
+			ld.anchors = append(ld.anchors, macroDef{file: file, pos: pos, def: def})
+		default:
+			ld.defs = append(ld.defs, macroDef{file: file, pos: pos, def: def})
+		}
+	}
+}
+
+func (ld *macroSetLoader) include(s *gem.Sequence) {
+	if len(s.Elems) != 2 {
+		ld.comp.errorf(s, "include needs exactly one file name")
+		return
+	}
+	a, err := s.Elems[1].Atom(gem.NotMeta, gem.IgnQuoted)
+	if err != nil || a.Txt == "" {
+		ld.comp.errorf(s.Elems[1], "expect file name")
+		return
+	}
+	rel := filepath.FromSlash(a.Txt)
+	if filepath.IsAbs(rel) {
+		ld.comp.errorf(a, "include file must be relative: '%s'", a.Txt)
+		return
+	}
+	file := filepath.Join(filepath.Dir(ld.comp.file), rel)
+	if r, err := filepath.Rel(ld.root, file); err != nil ||
+		r == ".." ||
+		strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		ld.comp.errorf(a, "include file outside macro directory: '%s'", a.Txt)
+		return
+	}
+	for _, f := range ld.files {
+		if f == file {
+			ld.comp.errorf(a, "include cycle: %s → %s",
+				strings.Join(ld.files, " → "),
+				file)
+			return
+		}
+	}
+	if ld.included[file] {
+		mlog.Debuga("skip already included `file`", file)
+		return
+	}
+	if len(ld.files) > maxIncludeDepth {
+		ld.comp.errorf(a, "includes nested deeper than %d", maxIncludeDepth)
+		return
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		ld.comp.errorf(a, "cannot include '%s': %s", a.Txt, err)
+		return
+	}
+	ld.read(file, src)
+}
+
+func (ld *macroSetLoader) compile() {
+	for _, d := range ld.anchors {
+		ld.comp.file, ld.comp.pos, ld.comp.macro = d.file, d.pos, ""
+		ld.comp.anchor(d.def)
+	}
+	for _, d := range ld.defs {
+		ld.comp.file, ld.comp.pos, ld.comp.macro = d.file, d.pos, ""
+		def := d.def
+		if len(def.Elems) == 0 {
+			ld.comp.errorf(def, "missing macro name")
+			continue
+		}
+		mname, err := def.Elems[0].Atom(gem.NotMeta, gem.NotQuoted)
+		if err != nil {
+			ld.comp.errorf(def.Elems[0], "macro name must be a plain atom")
+			continue
+		}
+		ld.comp.macro = mname.Txt
+		if ld.set.find(mname.Txt) >= 0 {
+			ld.comp.errorf(mname, "duplicate macro name")
+			continue
+		}
+		m := macro{name: mname.Txt, pause: ld.set.pause, human: ld.set.human}
+		body := def.Elems[1:]
+		if len(body) > 0 {
+			if s, ok := body[0].(*gem.Sequence); ok && s.Meta() {
+				attrs := ld.comp.attrs(s,
+					"pause", "humanize", "params", "repeat", "cooldown", "group")
+				m.pause = ld.comp.pause(attrs, m.pause)
+				m.repeat = ld.comp.repeat(attrs)
+				m.cooldown = ld.comp.cooldown(attrs)
+				m.group = ld.comp.group(attrs)
+				m.human = ld.comp.humanize(attrs, m.human)
+				m.params = ld.comp.params(attrs)
+				body = body[1:]
+			}
+		}
+		ld.comp.cur = &m
+		m.steps = ld.comp.compile(body)
+		ld.comp.cur = nil
+		ld.set.macros = append(ld.set.macros, m)
+	}
+}
+
+// resolveCalls links all (call name) steps to the called macros. It also
+// rejects call cycles, call chains deeper than maxCallDepth and loops around
+// calls whose iterations multiplied with the loops of the called macros
+// exceed maxMacroRepeat.
+func (ld *macroSetLoader) resolveCalls() {
+	callees := make(map[string][]*macroCall)
+	for _, c := range ld.comp.calls {
+		i := ld.set.find(c.step.name)
+		if i < 0 {
+			ld.comp.errs = append(ld.comp.errs, c.errorf("call to unknown macro '%s'", c.step.name))
+			continue
+		}
+		c.step.m = &ld.set.macros[i]
+		callees[c.at.Macro] = append(callees[c.at.Macro], c)
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	depth := make(map[string]int)
+	weight := make(map[string]int)
+	var path []string
+	var visit func(name string) int
+	visit = func(name string) int {
+		switch state[name] {
+		case visiting:
+			return -1
+		case visited:
+			return depth[name]
+		}
+		state[name] = visiting
+		path = append(path, name)
+		d, w := 0, ld.comp.weights[name]
+		if w < 1 {
+			w = 1
+		}
+		for _, c := range callees[name] {
+			cd := visit(c.step.name)
+			if cd < 0 {
+				ld.comp.errs = append(ld.comp.errs, c.errorf("call cycle: %s → %s",
+					strings.Join(path, " → "),
+					c.step.name,
+				))
+				continue
+			}
+			ld.callParams(c)
+			cw := c.loops
+			if cw < 1 {
+				cw = 1
+			}
+			if cw *= weight[c.step.name]; cw > maxMacroRepeat {
+				ld.comp.errs = append(ld.comp.errs, c.errorf(
+					"loops with call to '%s' exceed %d iterations",
+					c.step.name, maxMacroRepeat,
+				))
+				cw = maxMacroRepeat
+			}
+			if cw > w {
+				w = cw
+			}
+			if cd+1 > d {
+				d = cd + 1
+			}
+			if d == maxCallDepth+1 && cd == maxCallDepth {
+				ld.comp.errs = append(ld.comp.errs, c.errorf(
+					"calls nested deeper than %d", maxCallDepth,
+				))
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		depth[name], weight[name] = d, w
+		return d
+	}
+	for _, m := range ld.set.macros {
+		visit(m.name)
+	}
+}
+
+// callParams checks that the caller of c declares all parameters of the
+// called macro, which is played with the arguments of the caller.
+func (ld *macroSetLoader) callParams(c *macroCall) {
+	caller := &ld.set.macros[ld.set.find(c.at.Macro)]
+	for _, p := range c.step.m.params {
+		cp := caller.param(p.Name)
+		if cp == nil {
+			ld.comp.errs = append(ld.comp.errs, c.errorf(
+				"call to '%s' needs undeclared parameter '%s'", c.step.name, p.Name,
+			))
+			continue
+		}
+		cp.Coordinate = cp.Coordinate || p.Coordinate
+	}
+}
+
+func logMacroErrors(err error) {
+	if mes, ok := err.(MacroErrors); ok {
+		for _, e := range mes {
+			mlog.Errore(e)
+		}
+	} else {
+		mlog.Errore(err)
+	}
+}
+
+// loadMacroSets reads all macro set files from dir. Sets that fail to load are
+// logged and replaced by the set with the same name from prev, if any.
+func loadMacroSets(dir string, prev []*macroCfg) (sets []*macroCfg) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		mlog.Infoa("no macros `dir`", dir)
+		return nil
+	} else if err != nil {
+		mlog.Errore(err)
+		return prev
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != MacroFileExt {
+			continue
+		}
+		file := filepath.Join(dir, e.Name())
+		mset, err := readMacroSet(file)
+		if err != nil {
+			logMacroErrors(err)
+			name := e.Name()[:len(e.Name())-len(MacroFileExt)]
+			for _, p := range prev {
+				if p.name == name {
+					mlog.Warna("keep previous version of macro `set`", name)
+					sets = append(sets, p)
+					break
+				}
+			}
+			continue
+		}
+		mlog.Infoa("loaded macro `set` with `count` macros", mset.name, len(mset.macros))
+		sets = append(sets, mset)
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].name < sets[j].name })
+	return sets
+}
+
+// macroStore holds the loaded macro sets and the current set. Loaded sets are
+// never modified, reloads replace them. Macros that are running when the sets
+// are replaced keep running with their original definition.
+type macroStore struct {
+	load    sync.Mutex // serializes loading the sets
+	mu      sync.RWMutex
+	sets    []*macroCfg
+	current *macroCfg
+	chosen  string // name of the set last made current on purpose
+}
+
+var noMacros = &macroCfg{}
+
+// cur returns the current macro set. Without a current set an empty set is
+// returned.
+func (ms *macroStore) cur() *macroCfg {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.current == nil {
+		return noMacros
+	}
+	return ms.current
+}
+
+func (ms *macroStore) all() []*macroCfg {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.sets
+}
+
+// replace makes sets the loaded macro sets. The set that was chosen with
+// switchTo or initially stays current if it is loaded. Otherwise the set named
+// dflt or, if there is none, the first set becomes current. The chosen set is
+// remembered, i.e. it becomes current again when it is loaded later.
+func (ms *macroStore) replace(sets []*macroCfg, dflt string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sets = sets
+	ms.current = nil
+	if len(sets) == 0 {
+		return
+	}
+	find := func(name string) *macroCfg {
+		for _, s := range sets {
+			if s.name == name {
+				return s
+			}
+		}
+		return nil
+	}
+	if ms.chosen == "" {
+		ms.chosen = dflt
+	}
+	if ms.current = find(ms.chosen); ms.current == nil {
+		if ms.chosen != "" {
+			mlog.Warna("cannot find macro `set`", ms.chosen)
+		}
+		if ms.current = find(dflt); ms.current == nil {
+			ms.current = sets[0]
+		}
+	}
+	if ms.chosen == "" {
+		ms.chosen = ms.current.name
+	}
+	mlog.Infoa("current macro `set`", ms.current.name)
+}
+
+// switchTo makes the loaded set with the given name the current set. It
+// returns false if there is no such set.
+func (ms *macroStore) switchTo(name string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, s := range ms.sets {
+		if s.name == name {
+			ms.current, ms.chosen = s, name
+			mlog.Infoa("switch to macro `set`", name)
+			return true
+		}
+	}
+	return false
+}
+
+// loadMacros (re-)loads the macro sets from g.MacrosDir. Initially the set
+// named g.MacroSet becomes the current macro set. Without a set name the first
+// set is used. If the current set is gone after a reload, g.MacroSet or the
+// first set is used until the current set is loaded again.
+func (g *Gamcro) loadMacros() {
+	g.macros.load.Lock()
+	defer g.macros.load.Unlock()
+	before := g.macros.cur().name
+	sets := loadMacroSets(g.MacrosDir, g.macros.all())
+	g.macros.replace(sets, g.MacroSet)
+	g.macroSetChanged(before)
+}
+
+// switchMacroSet makes the macro set name the current set. Macros that are
+// running keep running.
+func (g *Gamcro) switchMacroSet(name string) bool {
+	before := g.macros.cur().name
+	if !g.macros.switchTo(name) {
+		return false
+	}
+	g.macroSetChanged(before)
+	return true
+}
+
+func (g *Gamcro) macroSetChanged(before string) {
+	current := g.macros.cur().name
+	if current == before {
+		return
+	}
+	atomic.AddInt64(&g.dataVersion, 1)
+	if g.OnMacroSet != nil {
+		g.OnMacroSet(current)
+	}
+}
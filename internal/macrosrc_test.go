@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.fractalqb.de/fractalqb/xsx/gem"
+)
+
+func TestParseMacroSrc_pos(t *testing.T) {
+	exprs, pos, err := parseMacroSrc("test", []byte(`(foo "a \"b\"" x)
+  (bar [\down Shift])`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(exprs); l != 2 {
+		t.Fatalf("expected 2 expressions, got %d", l)
+	}
+	check := func(x gem.Expr, line, col int) {
+		t.Helper()
+		if p := pos[x]; p.Line != line || p.Col != col {
+			t.Errorf("%s: expect position %d:%d, got %s", x, line, col, p)
+		}
+	}
+	foo := exprs[0].(*gem.Sequence)
+	check(foo, 1, 1)
+	check(foo.Elems[0], 1, 2)
+	check(foo.Elems[1], 1, 6)
+	if txt := foo.Elems[1].(*gem.Atom).Txt; txt != `a "b"` {
+		t.Errorf("unexpected quoted atom [%s]", txt)
+	}
+	check(foo.Elems[2], 1, 16)
+	bar := exprs[1].(*gem.Sequence)
+	check(bar, 2, 3)
+	check(bar.Elems[1], 2, 8)
+	check(bar.Elems[1].(*gem.Sequence).Elems[0], 2, 9)
+	check(bar.Elems[1].(*gem.Sequence).Elems[1], 2, 15)
+}
+
+func TestParseMacroSet(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(greet "Hello" Enter)
+(jump space)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mset.name != "test" {
+		t.Errorf("wrong set name '%s'", mset.name)
+	}
+	if l := len(mset.macros); l != 2 {
+		t.Fatalf("expected 2 macros, got %d", l)
+	}
+	if i := mset.find("jump"); i != 1 {
+		t.Errorf("jump found at %d", i)
+	}
+	if l := len(mset.macros[0].steps); l != 2 {
+		t.Errorf("greet has %d steps", l)
+	}
+}
+
+func TestParseMacroSet_errors(t *testing.T) {
+	test := func(src string, line, col int, macro string) {
+		t.Run(src, func(t *testing.T) {
+			_, err := parseMacroSet("test", "test.xsx", []byte(src))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			merrs, ok := err.(MacroErrors)
+			if !ok {
+				t.Fatalf("unexpected error type %T", err)
+			}
+			if len(merrs) != 1 {
+				t.Fatalf("expect 1 error, got %d", len(merrs))
+			}
+			merr := merrs[0]
+			if merr.File != "test.xsx" {
+				t.Errorf("wrong file '%s'", merr.File)
+			}
+			if merr.Line != line || merr.Col != col {
+				t.Errorf("wrong position %s", merr.srcPos)
+			}
+			if merr.Macro != macro {
+				t.Errorf("wrong macro '%s'", merr.Macro)
+			}
+		})
+	}
+	test("(a x)\n  foo", 2, 3, "")
+	test("(a x)\n[b x]", 2, 1, "")
+	test("(a x) ()", 1, 7, "")
+	test(`("a" x)`, 1, 2, "")
+	test("(a x)\n(a y)", 2, 2, "a")
+	test("(a x]", 1, 5, "")
+}
+
+func TestLoadMacroSets(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("b.xsx", "(m1 x)")
+	write("a.xsx", "(m2 y) (m3 z)")
+	write("broken.xsx", "(m4 y")
+	write("notes.txt", "no macros")
+	sets := loadMacroSets(dir, nil)
+	if l := len(sets); l != 2 {
+		t.Fatalf("expected 2 sets, got %d", l)
+	}
+	if sets[0].name != "a" || sets[1].name != "b" {
+		t.Errorf("unexpected sets %s, %s", sets[0].name, sets[1].name)
+	}
+}
+
+func TestParseMacroSet_calls(t *testing.T) {
+	mset, err := parseMacroSet("test", "test.xsx", []byte(`(a x (call b))
+(b y)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := mset.macros[0].steps[1].(*stepCall)
+	if call.m != &mset.macros[1] {
+		t.Error("call not resolved to macro b")
+	}
+}
+
+func TestParseMacroSet_callErrors(t *testing.T) {
+	test := func(name, src string, errNo int) {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseMacroSet("test", "test.xsx", []byte(src))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if l := len(err.(MacroErrors)); l != errNo {
+				t.Errorf("expect %d errors, got %d:\n%s", errNo, l, err)
+			}
+		})
+	}
+	test("unknown", "(a (call b))", 1)
+	test("self", "(a x (call a))", 1)
+	test("cycle", "(a (call b)) (b (call c)) (c (call a)) (d (call b))", 1)
+	var sb strings.Builder
+	for i := 0; i <= maxCallDepth+1; i++ {
+		fmt.Fprintf(&sb, "(m%d (call m%d))\n", i, i+1)
+	}
+	fmt.Fprintf(&sb, "(m%d x)", maxCallDepth+2)
+	test("too deep", sb.String(), 1)
+}
+
+func TestParseMacroSet_include(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	write("lib/chat.xsx", `(include "keys.xsx") (open-chat (call enter))`)
+	write("lib/keys.xsx", `(enter Enter)`)
+	write("lib/loop.xsx", `(include "../loop.xsx")`)
+	write("other/evil.xsx", `(evil x)`)
+	t.Run("include", func(t *testing.T) {
+		main := write("main.xsx", `(include "lib/chat.xsx")
+(include "lib/keys.xsx")
+(greet (call open-chat) "Hello" (call enter))`)
+		mset, err := readMacroSet(main)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := len(mset.macros); l != 3 {
+			t.Errorf("expect 3 macros, got %d", l)
+		}
+	})
+	t.Run("cycle", func(t *testing.T) {
+		main := write("loop.xsx", `(include "lib/loop.xsx") (m x)`)
+		_, err := readMacroSet(main)
+		if err == nil {
+			t.Fatal("no error")
+		}
+		merrs := err.(MacroErrors)
+		if len(merrs) != 1 || !strings.Contains(merrs[0].Msg, "cycle") {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if merrs[0].File != filepath.Join(dir, "lib/loop.xsx") {
+			t.Errorf("error in wrong file: %s", merrs[0].File)
+		}
+	})
+	t.Run("outside", func(t *testing.T) {
+		main := write("other/main.xsx", `(include "../../x.xsx")`)
+		if _, err := readMacroSet(main); err == nil {
+			t.Error("included file outside of macro dir")
+		}
+		main = write("other/main.xsx", `(include "evil.xsx")`)
+		if _, err := readMacroSet(main); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// filePollInterval is how often Gamcro checks the macro and text files for
+// changes.
+const filePollInterval = 2 * time.Second
+
+type fileStamp struct {
+	mod, size int64
+}
+
+// dirStamps returns the modification times and sizes of all files with
+// extension ext in dir. With deep set, files in subdirectories are included.
+func dirStamps(dir, ext string, deep bool) map[string]fileStamp {
+	res := make(map[string]fileStamp)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return nil
+		case d.IsDir():
+			if !deep && path != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		case filepath.Ext(path) != ext:
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			res[path] = fileStamp{mod: info.ModTime().UnixNano(), size: info.Size()}
+		}
+		return nil
+	})
+	return res
+}
+
+func sameStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for f, s := range a {
+		if t, ok := b[f]; !ok || s != t {
+			return false
+		}
+	}
+	return true
+}
+
+// fileWatch remembers the state of the macro and text files from the last
+// check.
+type fileWatch struct {
+	macros, texts map[string]fileStamp
+}
+
+// loadFiles loads the macro and text sets and starts to watch their files.
+func (g *Gamcro) loadFiles() {
+	g.watch.macros = dirStamps(g.MacrosDir, MacroFileExt, true)
+	g.watch.texts = dirStamps(g.TextsDir, textFileExt, false)
+	g.loadMacros()
+	g.loadTexts()
+	atomic.AddInt64(&g.dataVersion, 1)
+}
+
+// checkFiles reloads the macro sets or the text sets when any of their files
+// changed since the last check. Every reload increments the data version
+// reported by /config.
+func (g *Gamcro) checkFiles() {
+	reload := false
+	if s := dirStamps(g.MacrosDir, MacroFileExt, true); !sameStamps(s, g.watch.macros) {
+		g.watch.macros = s
+		mlog.Infoa("reload macros from `dir`", g.MacrosDir)
+		g.loadMacros()
+		reload = true
+	}
+	if s := dirStamps(g.TextsDir, textFileExt, false); !sameStamps(s, g.watch.texts) {
+		g.watch.texts = s
+		log.Infoa("reload texts from `dir`", g.TextsDir)
+		g.loadTexts()
+		reload = true
+	}
+	if reload {
+		atomic.AddInt64(&g.dataVersion, 1)
+	}
+}
+
+func (g *Gamcro) watchFiles(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		g.checkFiles()
+	}
+}
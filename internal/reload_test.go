@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckFiles(t *testing.T) {
+	g := &Gamcro{
+		MacrosDir: t.TempDir(),
+		TextsDir:  t.TempDir(),
+	}
+	mtime := time.Now().Add(-time.Hour)
+	write := func(dir, name, src string) {
+		t.Helper()
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		mtime = mtime.Add(time.Second)
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(g.MacrosDir, "game.xsx", "(a x)")
+	write(g.TextsDir, "chat.json", `["hi"]`)
+	g.loadFiles()
+	version := g.dataVersion
+	if version == 0 {
+		t.Fatal("data version not set by load")
+	}
+	running := g.macros.cur()
+	g.checkFiles()
+	if g.dataVersion != version || g.macros.cur() != running {
+		t.Fatal("reload without file change")
+	}
+	write(g.MacrosDir, "game.xsx", "(a x) (b y)")
+	write(g.TextsDir, "chat.json", `["hi", "bye"]`)
+	g.checkFiles()
+	if g.dataVersion <= version {
+		t.Errorf("data version after reload is %d", g.dataVersion)
+	}
+	if mset := g.macros.cur(); mset.name != "game" || len(mset.macros) != 2 {
+		t.Errorf("unexpected macro set after reload: %+v", mset)
+	}
+	if running.find("b") >= 0 {
+		t.Error("reload modified the running macro set")
+	}
+	if txts, _ := g.texts.get("chat"); !reflect.DeepEqual(txts, []string{"hi", "bye"}) {
+		t.Errorf("unexpected texts after reload: %q", txts)
+	}
+	good := g.macros.cur()
+	write(g.MacrosDir, "game.xsx", "(a x) (b")
+	write(g.TextsDir, "chat.json", `["hi", `)
+	g.checkFiles()
+	if g.macros.cur() != good {
+		t.Error("broken macro file replaced the set")
+	}
+	if txts, _ := g.texts.get("chat"); len(txts) != 2 {
+		t.Errorf("broken text file replaced the set: %q", txts)
+	}
+}
+
+func TestLoadMacros_currentGone(t *testing.T) {
+	g := &Gamcro{MacrosDir: t.TempDir(), MacroSet: "game"}
+	write := func(name, src string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(g.MacrosDir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("game.xsx", "(a x)")
+	write("other.xsx", "(b y)")
+	write("work.xsx", "(c z)")
+	g.loadMacros()
+	if !g.switchMacroSet("other") {
+		t.Fatal("cannot switch to other set")
+	}
+	g.loadMacros()
+	if cur := g.macros.cur().name; cur != "other" {
+		t.Errorf("reload switched to set '%s'", cur)
+	}
+	if err := os.Remove(filepath.Join(g.MacrosDir, "other.xsx")); err != nil {
+		t.Fatal(err)
+	}
+	g.loadMacros()
+	if cur := g.macros.cur().name; cur != "game" {
+		t.Errorf("current set '%s' after removing other set", cur)
+	}
+	write("other.xsx", "(b y)")
+	g.loadMacros()
+	if cur := g.macros.cur().name; cur != "other" {
+		t.Errorf("current set '%s' after restoring other set", cur)
+	}
+	g.MacroSet = ""
+	g.switchMacroSet("game")
+	if err := os.Remove(filepath.Join(g.MacrosDir, "game.xsx")); err != nil {
+		t.Fatal(err)
+	}
+	g.loadMacros()
+	if cur := g.macros.cur().name; cur != "other" {
+		t.Errorf("current set '%s' without default set", cur)
+	}
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// repeaterState is what GET /macros/running reports about a repeater.
+type repeaterState struct {
+	Macro    string
+	Interval float64 // milliseconds
+	Client   string
+	Started  time.Time
+	Runs     int
+}
+
+// macroRepeater plays a macro with a \{repeat interval} attribute again and
+// again until it is stopped. The interval is the time between the end of one
+// run and the start of the next.
+type macroRepeater struct {
+	repeaterState
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (rp *macroRepeater) halt() {
+	rp.stopOnce.Do(func() { close(rp.stop) })
+}
+
+// repeaters are the running macro repeaters, at most one per macro name.
+type repeaters struct {
+	mu  sync.Mutex
+	run map[string]*macroRepeater
+	wg  sync.WaitGroup
+}
+
+// toggle stops the repeater of m if it is running. Otherwise it starts a new
+// repeater for m that was requested by client. It returns the state of the
+// new repeater and false if the repeater was stopped.
+func (rs *repeaters) toggle(x *inputExec, m *macro, args map[string]string, client string) (repeaterState, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rp := rs.run[m.name]; rp != nil {
+		mlog.Infoa("stop repeating `macro`", m.name)
+		rp.halt()
+		delete(rs.run, m.name)
+		return repeaterState{}, false
+	}
+	rp := &macroRepeater{
+		repeaterState: repeaterState{
+			Macro:    m.name,
+			Interval: planMillis(m.repeat),
+			Client:   client,
+			Started:  time.Now(),
+		},
+		stop: make(chan struct{}),
+	}
+	if rs.run == nil {
+		rs.run = make(map[string]*macroRepeater)
+	}
+	rs.run[m.name] = rp
+	rs.wg.Add(1)
+	mlog.Infoa("repeat `macro` every `interval` for `client`", m.name, m.repeat, client)
+	go rs.loop(x, rp, m, args)
+	return rp.repeaterState, true
+}
+
+func (rs *repeaters) loop(x *inputExec, rp *macroRepeater, m *macro, args map[string]string) {
+	defer rs.wg.Done()
+	defer rs.remove(rp)
+	for {
+		job, err := x.runMacro(m, args)
+		if err != nil {
+			mlog.Warna("repeat `macro`: `error`", m.name, err)
+		} else {
+			select {
+			case <-job.done:
+			case <-rp.stop:
+				x.cancel(job.ID)
+				<-job.done
+				return
+			}
+			rs.mu.Lock()
+			rp.Runs++
+			rs.mu.Unlock()
+		}
+		t := time.NewTimer(m.repeat)
+		select {
+		case <-rp.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (rs *repeaters) remove(rp *macroRepeater) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.run[rp.Macro] == rp {
+		delete(rs.run, rp.Macro)
+	}
+}
+
+// list returns the states of the running repeaters sorted by macro name.
+func (rs *repeaters) list() []repeaterState {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	res := make([]repeaterState, 0, len(rs.run))
+	for _, rp := range rs.run {
+		res = append(res, rp.repeaterState)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Macro < res[j].Macro })
+	return res
+}
+
+// stop stops all repeaters that were started by client or, with client "",
+// all repeaters. With wait set, stop returns after the repeaters' macros are
+// cancelled.
+func (rs *repeaters) stop(client string, wait bool) {
+	rs.mu.Lock()
+	for name, rp := range rs.run {
+		if client == "" || rp.Client == client {
+			mlog.Infoa("stop repeating `macro` of `client`", name, rp.Client)
+			rp.halt()
+			delete(rs.run, name)
+		}
+	}
+	rs.mu.Unlock()
+	if wait {
+		rs.wg.Wait()
+	}
+}
+
+func clientHost(rq *http.Request) string {
+	if h, _, err := net.SplitHostPort(rq.RemoteAddr); err == nil {
+		return h
+	}
+	return rq.RemoteAddr
+}
+
+// handleMacroToggle starts repeating a macro or stops it if it is already
+// repeating.
+func (g *Gamcro) handleMacroToggle(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	name := mux.Vars(rq)["name"]
+	mset := g.macros.cur()
+	idx := mset.find(name)
+	if idx < 0 {
+		log.Warna("no `macro` in `set`", name, mset.name)
+		http.Error(wr, "not found", http.StatusNotFound)
+		return
+	}
+	m := &mset.macros[idx]
+	if m.repeat <= 0 {
+		http.Error(wr, "macro has no repeat interval", http.StatusBadRequest)
+		return
+	}
+	args, err := g.macroArgs(wr, rq, m)
+	if err != nil {
+		log.Warna("`macro` arguments: `error`", name, err)
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, started := g.repeat.toggle(g.inputs(), m, args, clientHost(rq))
+	if !started {
+		wr.WriteHeader(http.StatusNoContent)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(wr).Encode(state)
+}
+
+func (g *Gamcro) listRunningMacros(wr http.ResponseWriter, rq *http.Request) {
+	if !g.mayRobo(MacroAPI, wr) {
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(g.repeat.list())
+}
+
+// Shutdown stops all repeating macros, cancels all macro jobs and then stops
+// the HTTPS server.
+func (g *Gamcro) Shutdown(ctx context.Context) error {
+	log.Infos("Shutdown gamcro")
+	g.repeat.stop("", true)
+	g.inputs().cancelAll()
+	g.srvMu.Lock()
+	srv := g.server
+	g.srvMu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
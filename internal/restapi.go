@@ -10,9 +10,7 @@ import (
 	"strings"
 	"unicode"
 
-	"github.com/atotto/clipboard"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
-	"github.com/go-vgo/robotgo"
 	"github.com/gorilla/mux"
 )
 
@@ -25,6 +23,8 @@ const (
 	ClipPostAPI
 	ClipGetAPI
 	SaveTexts
+	MacroAPI
+	MacroEditAPI
 
 	GamcroAPI_end
 )
@@ -88,6 +88,48 @@ func (g *Gamcro) apiRoutes(r *mux.Router) {
 	r.HandleFunc("/texts/{set}", g.auth(g.saveText)).
 		Methods(http.MethodPost).
 		HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/macros", g.auth(g.listMacros)).
+		Methods(http.MethodGet)
+	r.HandleFunc("/macros/running", g.auth(g.listRunningMacros)).
+		Methods(http.MethodGet)
+	r.HandleFunc("/macros/record", g.auth(g.handleRecordStart)).
+		Methods(http.MethodPost)
+	r.HandleFunc("/macros/record/{id:[0-9]+}", g.auth(g.handleRecordDiscard)).
+		Methods(http.MethodDelete)
+	r.HandleFunc("/macros/record/{id:[0-9]+}/events", g.auth(g.handleRecordEvents)).
+		Methods(http.MethodPost).
+		HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/macros/record/{id:[0-9]+}/finish", g.auth(g.handleRecordFinish)).
+		Methods(http.MethodPost).
+		HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/macros/{set}", g.auth(g.getMacroSrc)).
+		Methods(http.MethodGet)
+	r.HandleFunc("/macros/{set}", g.auth(g.putMacroSrc)).
+		Methods(http.MethodPut).
+		HeadersRegexp("Content-Type", "text/plain")
+	r.HandleFunc("/macros/{set}", g.auth(g.deleteMacroSrc)).
+		Methods(http.MethodDelete)
+	r.HandleFunc("/macros/{name}/run", g.auth(g.handleMacroRun)).
+		Methods(http.MethodPost)
+	r.HandleFunc("/macros/{name}/dry-run", g.auth(g.handleMacroDryRun)).
+		Methods(http.MethodPost)
+	r.HandleFunc("/macros/{name}/toggle", g.auth(g.handleMacroToggle)).
+		Methods(http.MethodPost)
+	r.HandleFunc("/macrosets", g.auth(g.listMacroSets)).
+		Methods(http.MethodGet)
+	r.HandleFunc("/macrosets/current", g.auth(g.handleMacroSetSwitch)).
+		Methods(http.MethodPut).
+		HeadersRegexp("Content-Type", "text/plain")
+	r.HandleFunc("/macros/jobs/{id:[0-9]+}", g.auth(g.getMacroJob)).
+		Methods(http.MethodGet)
+	r.HandleFunc("/macros/jobs/{id:[0-9]+}/step", g.auth(g.handleMacroStep)).
+		Methods(http.MethodPost)
+	r.HandleFunc("/macros/jobs/{id:[0-9]+}/continue", g.auth(g.handleMacroContinue)).
+		Methods(http.MethodPost)
+	r.HandleFunc("/macros/jobs/{id:[0-9]+}", g.auth(g.handleMacroCancel)).
+		Methods(http.MethodDelete)
+	r.HandleFunc("/macros/jobs/{id:[0-9]+}/release", g.auth(g.handleMacroRelease)).
+		Methods(http.MethodPost)
 }
 
 func (g *Gamcro) rqBodyRd(wr http.ResponseWriter, rq *http.Request) io.ReadCloser {
@@ -121,7 +163,7 @@ func cleanText(s string) string {
 
 func validQuery(rq *http.Request, r validation.MapRule) (map[string][]string, error) {
 	qry := rq.URL.Query()
-	err := validKbdTapQuery.Validate(qry)
+	err := r.Validate(qry)
 	return qry, err
 }
 
@@ -145,14 +187,34 @@ func (g *Gamcro) handleKeyboardType(wr http.ResponseWriter, rq *http.Request) {
 	if !g.mayRobo(TypeAPI, wr) {
 		return
 	}
+	qry, err := validQuery(rq, validKbdTypeQuery)
+	if err != nil {
+		log.Warna("keyboard/type query: `error`", err)
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := g.typeOptsQuery(qry)
+	if err != nil {
+		log.Warna("keyboard/type: `error`", err)
+		http.Error(wr, err.Error(), http.StatusForbidden)
+		return
+	}
 	body, err := g.rqBody(wr, rq)
 	if httpError(wr, err, "read body") {
 		return
 	}
 	if len(body) > 0 {
-		txt := cleanText(string(body))
-		log.Infoa("keyboard/type `text`", txt)
-		robotgo.TypeStr(txt)
+		txt := string(body)
+		if d := opts.duration(txt); d > maxTypeTime {
+			log.Warna("keyboard/type would take `duration`", d)
+			http.Error(wr, fmt.Sprintf("typing would take longer than %s", maxTypeTime),
+				http.StatusBadRequest)
+			return
+		}
+		log.Infoa("keyboard/type `text` with `delay` `hold` `newline` `tab`",
+			cleanText(txt), opts.delay, opts.hold, opts.newline, opts.tab)
+		ctx := rq.Context()
+		g.inputs().do(func() { typeText(ctx, g.Input, txt, opts) })
 	}
 	wr.WriteHeader(http.StatusNoContent)
 }
@@ -174,11 +236,9 @@ func (g *Gamcro) handleKeyboardTap(wr http.ResponseWriter, rq *http.Request) {
 	}
 	args := qry["arg"]
 	log.Infoa("keyboard/tap `key` with `args`", key, args)
-	var tapargs = make([]interface{}, len(args))
-	for i, a := range args {
-		tapargs[i] = a
-	}
-	if res := robotgo.KeyTap(key, tapargs...); res != "" {
+	var res string
+	g.inputs().do(func() { res = g.Input.KeyTap(key, args...) })
+	if res != "" {
 		log.Errora("keyboard/tap `error`", res)
 		http.Error(wr, "internal server error", http.StatusInternalServerError)
 		return
@@ -197,7 +257,7 @@ func (g *Gamcro) handleClipPost(wr http.ResponseWriter, rq *http.Request) {
 	if len(body) > 0 {
 		txt := cleanText(string(body))
 		log.Infoa("clip `text` to board", txt)
-		err = clipboard.WriteAll(txt)
+		g.inputs().do(func() { err = g.Clipboard.WriteAll(txt) })
 		if httpError(wr, err, "clip write") {
 			return
 		}
@@ -210,7 +270,9 @@ func (g *Gamcro) handleClipGet(wr http.ResponseWriter, rq *http.Request) {
 	if !g.mayRobo(ClipGetAPI, wr) {
 		return
 	}
-	txt, err := clipboard.ReadAll()
+	var txt string
+	var err error
+	g.inputs().do(func() { txt, err = g.Clipboard.ReadAll() })
 	if httpError(wr, err, "clip read") {
 		return
 	}
@@ -221,31 +283,9 @@ func (g *Gamcro) handleClipGet(wr http.ResponseWriter, rq *http.Request) {
 
 func (g *Gamcro) listTexts(wr http.ResponseWriter, rq *http.Request) {
 	log.Debugs("list texts")
-	dir, err := os.Open(g.TextsDir)
-	if httpError(wr, err, "read `dir`", g.TextsDir) {
-		return
-	}
-	defer dir.Close()
-	entries, err := dir.ReadDir(0)
-	if err != nil {
-		log.Errore(err)
-		http.Error(wr, "internal server error", http.StatusInternalServerError)
-		return
-	}
-	ls := []string{}
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
-		}
-		n := e.Name()
-		if filepath.Ext(n) == ".json" {
-			n = n[:len(n)-5]
-			ls = append(ls, n)
-		}
-	}
 	enc := json.NewEncoder(wr)
 	wr.Header().Set("Content-Type", "application/json")
-	enc.Encode(ls)
+	enc.Encode(g.texts.names())
 }
 
 func (g *Gamcro) loadText(wr http.ResponseWriter, rq *http.Request) {
@@ -256,14 +296,13 @@ func (g *Gamcro) loadText(wr http.ResponseWriter, rq *http.Request) {
 		http.Error(wr, "internal server error", http.StatusInternalServerError)
 		return
 	}
-	file := filepath.Join(g.TextsDir, setName+".json")
-	rd, err := os.Open(file)
-	if httpError(wr, err, "open `file`", file) {
+	txts, ok := g.texts.get(setName)
+	if !ok {
+		http.Error(wr, "not found", http.StatusNotFound)
 		return
 	}
-	defer rd.Close()
 	wr.Header().Set("Content-Type", "application/json")
-	io.Copy(wr, rd)
+	json.NewEncoder(wr).Encode(txts)
 }
 
 func (g *Gamcro) saveText(wr http.ResponseWriter, rq *http.Request) {
@@ -273,6 +312,12 @@ func (g *Gamcro) saveText(wr http.ResponseWriter, rq *http.Request) {
 		http.Error(wr, "internal server error", http.StatusInternalServerError)
 		return
 	}
+	var txts []string
+	if err := json.NewDecoder(rq.Body).Decode(&txts); err != nil { // TODO limit size?
+		log.Warna("invalid `text set`: `error`", setName, err)
+		http.Error(wr, "bad request", http.StatusBadRequest)
+		return
+	}
 	if _, err := os.Stat(g.TextsDir); os.IsNotExist(err) {
 		log.Infoa("create `texts dir`", g.TextsDir)
 		if err = os.MkdirAll(g.TextsDir, 0777); err != nil {
@@ -281,7 +326,7 @@ func (g *Gamcro) saveText(wr http.ResponseWriter, rq *http.Request) {
 			return
 		}
 	}
-	file := filepath.Join(g.TextsDir, setName+".json")
+	file := filepath.Join(g.TextsDir, setName+textFileExt)
 	tmpf := file + "~"
 	log.Infoa("save to `texts file`", file)
 	txtwr, err := os.Create(tmpf)
@@ -291,7 +336,9 @@ func (g *Gamcro) saveText(wr http.ResponseWriter, rq *http.Request) {
 		return
 	}
 	defer txtwr.Close()
-	if _, err := io.Copy(txtwr, rq.Body); err != nil { // TODO limit size?
+	enc := json.NewEncoder(txtwr)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(txts); err != nil {
 		log.Errore(err)
 		http.Error(wr, "internal server error", http.StatusInternalServerError)
 		return
@@ -299,5 +346,7 @@ func (g *Gamcro) saveText(wr http.ResponseWriter, rq *http.Request) {
 	txtwr.Close()
 	if err = os.Rename(tmpf, file); err != nil {
 		log.Errore(err)
+		return
 	}
+	g.texts.put(setName, txts)
 }
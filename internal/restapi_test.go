@@ -4,8 +4,11 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/gorilla/mux"
 )
 
 func TestValidKbdTapQuery(t *testing.T) {
@@ -60,4 +63,80 @@ func TestAPISwitches(t *testing.T) {
 	asTest(gamcro.handleKeyboardTap, http.MethodPost, "/keyboard/tap/x", "")
 	asTest(gamcro.handleClipPost, http.MethodPost, "/clip", "clip post")
 	asTest(gamcro.handleClipGet, http.MethodGet, "/clip", "")
+	asTest(gamcro.listMacros, http.MethodGet, "/macros", "")
+	asTest(gamcro.handleMacroRun, http.MethodPost, "/macros/x/run", "")
+	asTest(gamcro.handleMacroDryRun, http.MethodPost, "/macros/x/dry-run", "")
+	asTest(gamcro.handleMacroToggle, http.MethodPost, "/macros/x/toggle", "")
+	asTest(gamcro.listRunningMacros, http.MethodGet, "/macros/running", "")
+	asTest(gamcro.listMacroSets, http.MethodGet, "/macrosets", "")
+	asTest(gamcro.handleMacroSetSwitch, http.MethodPut, "/macrosets/current", "")
+	asTest(gamcro.getMacroSrc, http.MethodGet, "/macros/x", "")
+	asTest(gamcro.putMacroSrc, http.MethodPut, "/macros/x", "")
+	asTest(gamcro.deleteMacroSrc, http.MethodDelete, "/macros/x", "")
+	asTest(gamcro.handleRecordStart, http.MethodPost, "/macros/record", "")
+	asTest(gamcro.handleRecordEvents, http.MethodPost, "/macros/record/1/events", "[]")
+	asTest(gamcro.handleRecordFinish, http.MethodPost, "/macros/record/1/finish", "{}")
+	asTest(gamcro.handleRecordDiscard, http.MethodDelete, "/macros/record/1", "")
+	asTest(gamcro.handleMacroCancel, http.MethodDelete, "/macros/jobs/1", "")
+	asTest(gamcro.handleMacroRelease, http.MethodPost, "/macros/jobs/1/release", "")
+	asTest(gamcro.getMacroJob, http.MethodGet, "/macros/jobs/1", "")
+	asTest(gamcro.handleMacroStep, http.MethodPost, "/macros/jobs/1/step", "")
+	asTest(gamcro.handleMacroContinue, http.MethodPost, "/macros/jobs/1/continue", "")
+}
+
+func TestMacroRun_notFound(t *testing.T) {
+	gamcro := Gamcro{APIs: MacroAPI}
+	rq := httptest.NewRequest(http.MethodPost, "/macros/nope/run", nil)
+	rq = mux.SetURLVars(rq, map[string]string{"name": "nope"})
+	rrec := httptest.NewRecorder()
+	gamcro.handleMacroRun(rrec, rq)
+	if rrec.Code != http.StatusNotFound {
+		t.Errorf("expect 404 not found, got: %s", rrec.Result().Status)
+	}
+}
+
+func TestMacroArgs(t *testing.T) {
+	gamcro := Gamcro{TxtLimit: 8}
+	m := &macro{name: "m", params: []macroParam{
+		{Name: "msg"},
+		{Name: "x", Coordinate: true},
+	}}
+	test := func(rq *http.Request, ok bool, expect map[string]string) {
+		t.Helper()
+		args, err := gamcro.macroArgs(httptest.NewRecorder(), rq, m)
+		if !ok {
+			if err == nil {
+				t.Errorf("no error for %s", rq.URL)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: %s", rq.URL, err)
+		} else if !reflect.DeepEqual(args, expect) {
+			t.Errorf("%s: unexpected args %v", rq.URL, args)
+		}
+	}
+	qry := func(q string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/macros/m/run?"+q, nil)
+	}
+	test(qry("msg=hi%0A!&x=%2B10"), true, map[string]string{"msg": "hi!", "x": "+10"})
+	test(qry("x=7"), true, map[string]string{"msg": "", "x": "7"})
+	test(qry("msg=hi"), false, nil)
+	test(qry("x=left"), false, nil)
+	test(qry("x=1&x=2"), false, nil)
+	test(qry("x=1&y=2"), false, nil)
+	test(qry("x=1&msg=too+long+text"), false, nil)
+	jrq := func(body string) *http.Request {
+		rq := httptest.NewRequest(http.MethodPost, "/macros/m/run", strings.NewReader(body))
+		rq.Header.Set("Content-Type", "application/json; charset=utf-8")
+		return rq
+	}
+	test(jrq(`{"msg":"hi","x":-3}`), true, map[string]string{"msg": "hi", "x": "-3"})
+	test(jrq(`{"msg":true,"x":-3}`), false, nil)
+	test(jrq(`{"x":1.5}`), false, nil)
+	test(jrq(`{"msg":"`+strings.Repeat(`\u00e9`, 8)+`", "x" : 1}`), true,
+		map[string]string{"msg": strings.Repeat("é", 8), "x": "1"})
+	test(jrq(`{"msg":"`+strings.Repeat(`\ud83d\ude00`, 8)+`","x":1}`), true,
+		map[string]string{"msg": strings.Repeat("\U0001F600", 8), "x": "1"})
+	test(jrq(`{"msg":"`+strings.Repeat("é", 9)+`","x":1}`), false, nil)
 }
@@ -454,6 +454,8 @@ var (
 
 func (g *Gamcro) releaseClient(wr http.ResponseWriter, rq *http.Request) {
 	log.Infoa("Release `client`", g.singleClient)
+	g.repeat.stop(clientHost(rq), false)
+	g.inputs().cancelDebug(clientHost(rq))
 	g.singleClient = ""
 	wr.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const textFileExt = ".json"
+
+// textStore holds the text sets read from the texts directory. A text set is
+// stored as a JSON array of strings.
+type textStore struct {
+	mu   sync.RWMutex
+	sets map[string][]string
+}
+
+func (ts *textStore) get(name string) ([]string, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	txts, ok := ts.sets[name]
+	return txts, ok
+}
+
+func (ts *textStore) names() []string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	res := make([]string, 0, len(ts.sets))
+	for n := range ts.sets {
+		res = append(res, n)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (ts *textStore) all() map[string][]string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.sets
+}
+
+func (ts *textStore) replace(sets map[string][]string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.sets = sets
+}
+
+// put replaces a single text set. The map of sets is copied because it may
+// be in use by readers.
+func (ts *textStore) put(name string, txts []string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	sets := make(map[string][]string, len(ts.sets)+1)
+	for n, t := range ts.sets {
+		sets[n] = t
+	}
+	sets[name] = txts
+	ts.sets = sets
+}
+
+func readTextSet(file string) (txts []string, err error) {
+	rd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	err = json.NewDecoder(rd).Decode(&txts)
+	return txts, err
+}
+
+// loadTextSets reads all text sets from dir. Sets that fail to load are logged
+// and replaced by the set with the same name from prev, if any.
+func loadTextSets(dir string, prev map[string][]string) map[string][]string {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		log.Debuga("no texts `dir`", dir)
+		return nil
+	} else if err != nil {
+		log.Errore(err)
+		return prev
+	}
+	sets := make(map[string][]string)
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() || filepath.Ext(n) != textFileExt {
+			continue
+		}
+		n = n[:len(n)-len(textFileExt)]
+		txts, err := readTextSet(filepath.Join(dir, e.Name()))
+		if err != nil {
+			log.Errora("load `text set`: `error`", n, err)
+			if p, ok := prev[n]; ok {
+				log.Warna("keep previous version of `text set`", n)
+				sets[n] = p
+			}
+			continue
+		}
+		sets[n] = txts
+	}
+	return sets
+}
+
+func (g *Gamcro) loadTexts() {
+	g.texts.replace(loadTextSets(g.TextsDir, g.texts.all()))
+}
@@ -0,0 +1,320 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+const (
+	// maxTypeDelay is the upper bound of the pause between two typed
+	// characters.
+	maxTypeDelay = 500 * time.Millisecond
+	// maxTypeHold is the upper bound of the time a key is held down when a
+	// character is typed.
+	maxTypeHold = 250 * time.Millisecond
+	// maxTypeTime is the upper bound of the time it takes to type a text
+	// with delay and hold.
+	maxTypeTime = time.Minute
+)
+
+// typeTiming controls how fast /keyboard/type sends text. With zero delay
+// and hold the whole text is typed in a single burst.
+type typeTiming struct {
+	delay time.Duration // pause between two characters
+	hold  time.Duration // time a key is held down
+}
+
+// clamp limits the timing to the allowed bounds.
+func (tm typeTiming) clamp() typeTiming {
+	if tm.delay < 0 {
+		tm.delay = 0
+	} else if tm.delay > maxTypeDelay {
+		tm.delay = maxTypeDelay
+	}
+	if tm.hold < 0 {
+		tm.hold = 0
+	} else if tm.hold > maxTypeHold {
+		tm.hold = maxTypeHold
+	}
+	return tm
+}
+
+// duration estimates how long it takes to type txt, assuming each
+// character takes delay and hold.
+func (tm typeTiming) duration(txt string) time.Duration {
+	return time.Duration(utf8.RuneCountInString(txt)) * (tm.delay + tm.hold)
+}
+
+// TypePolicy is what /keyboard/type does with a newline or a tab in the
+// text. TypePolicy values can be combined to the set of policies clients may
+// choose.
+type TypePolicy uint8
+
+const (
+	DropCtrl      TypePolicy = (1 << iota) // drop the character
+	TapEnter                               // tap Enter
+	TapShiftEnter                          // tap Shift+Enter
+	TapTab                                 // tap Tab
+
+	TypePolicy_end
+)
+
+var typePolicyNames = []string{"drop", "enter", "shift-enter", "tab"}
+
+func (p TypePolicy) String() string {
+	for i, n := range typePolicyNames {
+		if p == 1<<i {
+			return n
+		}
+	}
+	return fmt.Sprintf("TypePolicy(%d)", uint8(p))
+}
+
+func (set TypePolicy) Active(p TypePolicy) bool { return set&p == p }
+
+func (set TypePolicy) FlagString() string {
+	var ls []string
+	for i, n := range typePolicyNames {
+		if set.Active(1 << i) {
+			ls = append(ls, n)
+		}
+	}
+	return strings.Join(ls, ",")
+}
+
+// ParseTypePolicy parses a single policy name.
+func ParseTypePolicy(name string) (TypePolicy, error) {
+	for i, n := range typePolicyNames {
+		if name == n {
+			return 1 << i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown type policy '%s'", name)
+}
+
+// ParseTypePolicies parses a comma separated list of policy names and ignores
+// unknown names.
+func ParseTypePolicies(flag string) (set TypePolicy) {
+	for _, name := range strings.Split(flag, ",") {
+		p, _ := ParseTypePolicy(strings.TrimSpace(name))
+		set |= p
+	}
+	return set
+}
+
+// keys returns the key tapped for a control character, "" for DropCtrl.
+func (p TypePolicy) keys() (key string, mods []string) {
+	switch p {
+	case TapEnter:
+		return "enter", nil
+	case TapShiftEnter:
+		return "enter", []string{"shift"}
+	case TapTab:
+		return "tab", nil
+	}
+	return "", nil
+}
+
+// typeOpts controls how /keyboard/type sends text.
+type typeOpts struct {
+	typeTiming
+	newline, tab TypePolicy
+}
+
+// typeText types txt to drv with the options opts. A CR LF pair or a single
+// CR counts as one newline. Other characters that are not graphic are
+// dropped. Holding keys down only works for ASCII letters, digits and the
+// space character. All other characters are typed as usual, i.e. without
+// hold. Typing stops when ctx is cancelled.
+func typeText(ctx context.Context, drv InputDriver, txt string, opts typeOpts) {
+	tp := typer{ctx: ctx, drv: drv, typeTiming: opts.typeTiming}
+	var seg strings.Builder
+	for i, r := range txt {
+		if ctx.Err() != nil {
+			return
+		}
+		var policy TypePolicy
+		switch {
+		case r == '\r':
+			policy = opts.newline
+		case r == '\n':
+			if i > 0 && txt[i-1] == '\r' {
+				continue
+			}
+			policy = opts.newline
+		case r == '\t':
+			policy = opts.tab
+		case unicode.IsGraphic(r):
+			seg.WriteRune(r)
+			continue
+		default:
+			continue
+		}
+		if key, mods := policy.keys(); key != "" {
+			tp.chars(seg.String())
+			seg.Reset()
+			tp.tap(key, mods)
+		}
+	}
+	tp.chars(seg.String())
+}
+
+type typer struct {
+	ctx context.Context
+	drv InputDriver
+	typeTiming
+	started bool
+}
+
+// next waits for the delay unless it is the first input. It returns false
+// if typing was cancelled.
+func (tp *typer) next() bool {
+	if tp.started && tp.delay > 0 && !tp.sleep(tp.delay) {
+		return false
+	}
+	tp.started = true
+	return true
+}
+
+// sleep waits for d and returns false if typing was cancelled before.
+func (tp *typer) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-tp.ctx.Done():
+		return false
+	}
+}
+
+func (tp *typer) tap(key string, mods []string) {
+	if !tp.next() {
+		return
+	}
+	if res := tp.drv.KeyTap(key, mods...); res != "" {
+		log.Errora("type `key`: `error`", key, res)
+	}
+}
+
+func (tp *typer) chars(txt string) {
+	if txt == "" {
+		return
+	}
+	if tp.delay <= 0 && tp.hold <= 0 {
+		if tp.next() {
+			tp.drv.TypeStr(txt)
+		}
+		return
+	}
+	for _, r := range txt {
+		if !tp.next() {
+			return
+		}
+		key, mods, ok := holdKey(r)
+		if tp.hold <= 0 || !ok {
+			tp.drv.TypeStr(string(r))
+			continue
+		}
+		if res := tp.drv.KeyToggle(key, true, mods...); res != "" {
+			log.Errora("type `key`: `error`", key, res)
+			tp.drv.TypeStr(string(r))
+			continue
+		}
+		tp.sleep(tp.hold) // release the key even if cancelled
+		if res := tp.drv.KeyToggle(key, false, mods...); res != "" {
+			log.Errora("release `key`: `error`", key, res)
+		}
+	}
+}
+
+// holdKey returns the key and modifiers that type r if r can be typed by
+// holding a key down.
+func holdKey(r rune) (key string, mods []string, ok bool) {
+	switch {
+	case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		return string(r), nil, true
+	case r >= 'A' && r <= 'Z':
+		return string(r - 'A' + 'a'), []string{"shift"}, true
+	case r == ' ':
+		return "space", nil, true
+	}
+	return "", nil, false
+}
+
+// validKbdTypeQuery ignores unknown query parameters like /keyboard/type did
+// before it had any.
+var validKbdTypeQuery = validation.Map(
+	validation.Key("delay", validation.By(validTypeDuration(maxTypeDelay))).Optional(),
+	validation.Key("hold", validation.By(validTypeDuration(maxTypeHold))).Optional(),
+	validation.Key("newline", validation.By(validTypePolicy)).Optional(),
+	validation.Key("tab", validation.By(validTypePolicy)).Optional(),
+).AllowExtraKeys()
+
+func validTypePolicy(v interface{}) error {
+	vs := v.([]string)
+	if len(vs) != 1 {
+		return errors.New("must be given once")
+	}
+	_, err := ParseTypePolicy(vs[0])
+	return err
+}
+
+// validTypeDuration checks that a query parameter is a single duration
+// between 0 and max.
+func validTypeDuration(max time.Duration) validation.RuleFunc {
+	return func(v interface{}) error {
+		vs := v.([]string)
+		if len(vs) != 1 {
+			return errors.New("must be given once")
+		}
+		d, err := time.ParseDuration(vs[0])
+		switch {
+		case err != nil:
+			return errors.New("must be a duration like 30ms")
+		case d < 0 || d > max:
+			return fmt.Errorf("must be between 0 and %s", max)
+		}
+		return nil
+	}
+}
+
+// typeOptsQuery returns the server's defaults for /keyboard/type overridden
+// by the validated query parameters delay, hold, newline and tab. It returns
+// an error if a client chooses a policy that is not in g.TypePolicies.
+func (g *Gamcro) typeOptsQuery(qry map[string][]string) (typeOpts, error) {
+	opts := typeOpts{
+		typeTiming: typeTiming{delay: g.TypeDelay, hold: g.TypeHold},
+		newline:    g.NewlinePolicy,
+		tab:        g.TabPolicy,
+	}
+	if vs := qry["delay"]; len(vs) == 1 {
+		opts.delay, _ = time.ParseDuration(vs[0])
+	}
+	if vs := qry["hold"]; len(vs) == 1 {
+		opts.hold, _ = time.ParseDuration(vs[0])
+	}
+	policy := func(param string, p *TypePolicy) error {
+		vs := qry[param]
+		if len(vs) != 1 {
+			return nil
+		}
+		q, _ := ParseTypePolicy(vs[0])
+		if q != *p && !g.TypePolicies.Active(q) {
+			return fmt.Errorf("%s policy '%s' is not allowed", param, q)
+		}
+		*p = q
+		return nil
+	}
+	if err := policy("newline", &opts.newline); err != nil {
+		return opts, err
+	}
+	return opts, policy("tab", &opts.tab)
+}
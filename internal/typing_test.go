@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTypePolicies(t *testing.T) {
+	set := ParseTypePolicies("enter, tab,bogus")
+	if set != TapEnter|TapTab {
+		t.Errorf("unexpected set %s", set.FlagString())
+	}
+	if s := set.FlagString(); s != "enter,tab" {
+		t.Errorf("unexpected flag string '%s'", s)
+	}
+	for p := TypePolicy(1); p < TypePolicy_end; p <<= 1 {
+		q, err := ParseTypePolicy(p.String())
+		if err != nil || q != p {
+			t.Errorf("cannot parse %s: %v", p, err)
+		}
+	}
+	if _, err := ParseTypePolicy("return"); err == nil {
+		t.Error("parsed unknown policy")
+	}
+}
+
+func TestTypeText_cancel(t *testing.T) {
+	drv := &recDriver{}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	opts := typeOpts{typeTiming: typeTiming{delay: 20 * time.Millisecond, hold: 20 * time.Millisecond}}
+	start := time.Now()
+	typeText(ctx, drv, strings.Repeat("a", 100), opts)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancelled typing took %s", d)
+	}
+	in := drv.recorded()
+	if len(in) == 0 || len(in)%2 != 0 {
+		t.Fatalf("unexpected input %q", in)
+	}
+	if in[len(in)-1] != "toggle a false []" {
+		t.Errorf("key not released: %q", in)
+	}
+}
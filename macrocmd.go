@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/CmdrVasquess/gamcro/internal"
+)
+
+// macroCmd runs the 'gamcro macro …' subcommands and returns the exit code.
+func macroCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, docMacroCmd)
+		return 2
+	}
+	switch args[0] {
+	case "plan":
+		return macroPlanCmd(args[1:])
+	case "check":
+		return macroCheckCmd(args[1:])
+	case "fmt":
+		return macroFmtCmd(args[1:])
+	case "import-ahk":
+		return macroImportAHKCmd(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown macro command '%s'\n", args[0])
+	fmt.Fprint(os.Stderr, docMacroCmd)
+	return 2
+}
+
+func macroPlanCmd(args []string) int {
+	flags := flag.NewFlagSet("macro plan", flag.ContinueOnError)
+	held := flags.Duration("held", internal.DefaultPlanHeld, docPlanHeldFlag)
+	seed := flags.Int64("seed", 0, docPlanSeedFlag)
+	texts := flags.String("texts", paths.LocalDataPath(internal.DefaultTextsDir), docPlanTextsFlag)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), docMacroPlanCmd)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+	margs := make(map[string]string)
+	for _, a := range flags.Args()[2:] {
+		eq := strings.IndexByte(a, '=')
+		if eq < 0 {
+			fmt.Fprintf(os.Stderr, "macro argument '%s' is not param=value\n", a)
+			return 2
+		}
+		margs[a[:eq]] = a[eq+1:]
+	}
+	plan, err := internal.PlanMacroFile(flags.Arg(0), flags.Arg(1), margs, *texts, *held, *seed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(plan)
+	return 0
+}
+
+// macroFiles returns the macro files from args. Like gamcro loads macro
+// sets, only the macro files directly in a directory are used. Files in
+// subdirectories are included by other files and are not macro sets on
+// their own. Without args the macros folder is used.
+func macroFiles(args []string) (files []string, err error) {
+	if len(args) == 0 {
+		args = []string{paths.LocalDataPath(internal.DefaultMacrosDir)}
+	}
+	for _, arg := range args {
+		st, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && filepath.Ext(e.Name()) == internal.MacroFileExt {
+				files = append(files, filepath.Join(arg, e.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+func macroCheckCmd(args []string) int {
+	flags := flag.NewFlagSet("macro check", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), docMacroCheckCmd)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	files, err := macroFiles(flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	exit := 0
+	for _, file := range files {
+		if err := internal.CheckMacroFile(file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit = 1
+		}
+	}
+	return exit
+}
+
+func macroFmtCmd(args []string) int {
+	flags := flag.NewFlagSet("macro fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, docFmtWriteFlag)
+	list := flags.Bool("l", false, docFmtListFlag)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), docMacroFmtCmd)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	files, err := macroFiles(flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	exit := 0
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit = 1
+			continue
+		}
+		res, err := internal.FormatMacroSrc(file, src)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit = 1
+			continue
+		}
+		changed := !bytes.Equal(src, res)
+		if *list && changed {
+			fmt.Println(file)
+		}
+		switch {
+		case *write:
+			if changed {
+				if err := writeFile(file, res); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					exit = 1
+				}
+			}
+		case !*list:
+			os.Stdout.Write(res)
+		}
+	}
+	return exit
+}
+
+func macroImportAHKCmd(args []string) int {
+	flags := flag.NewFlagSet("macro import-ahk", flag.ContinueOnError)
+	out := flags.String("o", "", docImportOutFlag)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), docMacroImportAHKCmd)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	file := flags.Arg(0)
+	src, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	res, err := internal.ImportAHK(file, name, src)
+	exit := 0
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit = 1
+	}
+	if res == nil {
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(res)
+	} else if err := writeFile(*out, res); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return exit
+}
+
+// writeFile replaces file with data by renaming a temporary file.
+func writeFile(file string, data []byte) error {
+	tmpf := file + "~"
+	if err := os.WriteFile(tmpf, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpf, file)
+}
+
+const (
+	docMacroCmd = `Usage: gamcro macro <command> …
+Commands are:
+ - check: check macro files for errors
+ - fmt: format macro files
+ - import-ahk: convert AutoHotkey Send commands into a macro set
+ - plan: show the timeline of a macro without sending input
+`
+
+	docMacroCheckCmd = `Usage: gamcro macro check [file|dir…]
+Checks macro files like gamcro does when it loads them. For directories
+the '.xsx' files directly in the directory are checked. Without arguments the macros folder is
+checked. Exits with status 1 if there are errors.
+`
+
+	docMacroFmtCmd = `Usage: gamcro macro fmt [flags] [file|dir…]
+Formats macro files in the canonical layout and prints them. For
+directories the '.xsx' files directly in the directory are formatted. Without arguments the macros folder is
+formatted.
+`
+
+	docMacroImportAHKCmd = `Usage: gamcro macro import-ahk [flags] <file.ahk>
+Converts the hotkeys with Send and Sleep commands of an AutoHotkey script
+into a macro set and prints it. Commands outside of hotkeys become a macro
+named after the file. Unsupported lines are reported and left out; then
+the exit status is 1.
+`
+
+	docImportOutFlag = `Write the macro set to this file instead of printing it.`
+
+	docFmtWriteFlag = `Write the result to the file instead of printing it.`
+
+	docFmtListFlag = `List files whose formatting differs from the canonical layout.`
+
+	docMacroPlanCmd = `Usage: gamcro macro plan [flags] <file> <macro> [param=value…]
+Walks the macro from the macro set file like gamcro would run it but
+only prints the planned input as JSON. Mouse coordinates are resolved
+for a 1920×1080 screen with the pointer at 0, 0 and the active window
+covering the whole screen.
+`
+
+	docPlanHeldFlag = `Time after which (while-held …) loops are released.`
+
+	docPlanSeedFlag = `Seed for the random timing of humanized macros, 0 picks a random seed.`
+
+	docPlanTextsFlag = `Directory with the text sets for (text set entry) steps.`
+)
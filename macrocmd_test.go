@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMacroFiles_includes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	game := write("game.xsx", `(include "lib/chat.xsx") (open-chat enter)`)
+	write("lib/chat.xsx", `(say-hi (call open-chat) "Hi")`)
+	write("notes.txt", "no macros")
+	files, err := macroFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{game}) {
+		t.Errorf("unexpected macro files %q", files)
+	}
+	if exit := macroCheckCmd([]string{dir}); exit != 0 {
+		t.Errorf("check exits with %d", exit)
+	}
+}
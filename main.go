@@ -2,14 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	_ "embed"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
+	"syscall"
 
 	"git.fractalqb.de/fractalqb/c4hgol"
 	"git.fractalqb.de/fractalqb/pack/ospath"
@@ -44,16 +47,25 @@ func showBanner() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "macro" {
+		os.Exit(macroCmd(os.Args[2:]))
+	}
 	showBanner()
 	flag.StringVar(&gamcro.SrvAddr, "addr", ":9420", docSrvAddrFlag)
 	flag.StringVar(&gamcro.TLSCert, "cert", paths.LocalData("cert.pem"), docTlsCertFlag)
 	flag.StringVar(&gamcro.TLSKey, "key", paths.LocalData("key.pem"), docTlsKeyFlag)
 	authFlag := flag.String("auth", "", fmt.Sprintf(docAuthCredsFlag, internal.DefaultCredsFile))
 	flag.IntVar(&gamcro.TxtLimit, "text-limit", 256, docTxtLimitFlag)
+	flag.DurationVar(&gamcro.TypeDelay, "type-delay", 0, docTypeDelayFlag)
+	flag.DurationVar(&gamcro.TypeHold, "type-hold", 0, docTypeHoldFlag)
+	fNewline := flag.String("newline", "drop", docNewlineFlag)
+	fTab := flag.String("tab", "drop", docTabFlag)
+	fTypePols := flag.String("type-policies", "", docTypePoliciesFlag)
 	flag.BoolVar(&gamcro.MultiClient, "multi-client", false, docMCltFlag)
 	flag.StringVar(&gamcro.ClientNet, "clients", "local", docClientsFlag)
 	fApis := flag.String("apis", gamcro.APIs.FlagString(), docAPIsFlag())
 	flag.StringVar(&gamcro.CORS, "cors", "", docCORSFlag)
+	flag.StringVar(&gamcro.MacroSet, "macro-set", "", docMacroSetFlag)
 	noPass := flag.Bool("no-passphrase", false, docNoPassFlag)
 	fQR := flag.Bool("qr", false, docQRFlag)
 	fLog := flag.String("log", "", c4hgol.LevelCfgDoc(nil))
@@ -78,9 +90,28 @@ func main() {
 		}
 	}
 	gamcro.APIs = internal.ParseRoboAPISet(*fApis)
+	var err error
+	if gamcro.NewlinePolicy, err = internal.ParseTypePolicy(*fNewline); err != nil {
+		log.Fatale(err)
+	}
+	if gamcro.TabPolicy, err = internal.ParseTypePolicy(*fTab); err != nil {
+		log.Fatale(err)
+	}
+	gamcro.TypePolicies = internal.ParseTypePolicies(*fTypePols)
 	gamcro.TextsDir = paths.LocalDataPath(internal.DefaultTextsDir)
+	gamcro.MacrosDir = paths.LocalDataPath(internal.DefaultMacrosDir)
 	log.Infof("Authenticate to realm \"Gamcro: %s\"", internal.CurrentRealmKey)
-	log.Fatale(gamcro.Run())
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := gamcro.Shutdown(context.Background()); err != nil {
+			log.Errore(err)
+		}
+	}()
+	if err := gamcro.Run(); err != nil {
+		log.Fatale(err)
+	}
 }
 
 func ensureCreds(flag string, cauth *internal.AuthCreds) (err error) {
@@ -224,6 +255,24 @@ credentials. The current settings are determined like this:
 
 	docTxtLimitFlag = `Limit the length of text input to API.`
 
+	docTypeDelayFlag = `Default pause between the characters sent with /keyboard/type,
+at most 500ms. Clients can choose another one with the 'delay'
+query parameter. With 0 the text is typed in a single burst.`
+
+	docTypeHoldFlag = `Default time a key is held down for each character sent with
+/keyboard/type, at most 250ms. Clients can choose another one with
+the 'hold' query parameter. Only works for ASCII letters, digits
+and space.`
+
+	docNewlineFlag = `What /keyboard/type does with newlines: 'drop' them, tap
+'enter', tap 'shift-enter' or tap 'tab'.`
+
+	docTabFlag = `What /keyboard/type does with tabs, same choices as for -newline.`
+
+	docTypePoliciesFlag = `Comma separated list of the newline and tab policies that clients
+may choose with the 'newline' and 'tab' query parameters of
+/keyboard/type in addition to the defaults, e.g. 'drop,enter'.`
+
 	docMCltFlag = `Allow more than one client machine to send macros.`
 
 	docClientsFlag = `Which API clients are allowed. If clients is not 'all' only
@@ -240,6 +289,11 @@ be used by any dubious program on your machine is a serious risk.`
 	docCORSFlag = `When not empty the value will be used for the HTTP 
 Access-Control-Allow-Origin header in HTTP responses. Also the
 Access-Control-Allow-Credentials header then is set true.`
+
+	docMacroSetFlag = `Name of the macro set to use. Macro sets are read from the
+'macros' folder next to the 'texts' folder. Each file with extension
+'.xsx' is one macro set named like the file without extension. When
+not set the first macro set in alphabetical order is used.`
 )
 
 func docAPIsFlag() string {